@@ -0,0 +1,202 @@
+package ibxmgo
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io/ioutil"
+)
+
+/* Returns true for Composer 669 ("if") and UNIS 669 ("JN") modules. The signature is short, so the header is checked as well. */
+func Is669(reader *bufio.Reader) bool {
+	header, e := reader.Peek(497)
+	if e != nil {
+		return false
+	}
+	if string(header[0:2]) != "if" && string(header[0:2]) != "JN" {
+		return false
+	}
+	numSamples, numPatterns := int(header[110]), int(header[111])
+	if numSamples > 64 || numPatterns < 1 || numPatterns > 128 || header[112] > 127 {
+		return false
+	}
+	for patIdx := 0; patIdx < numPatterns; patIdx++ {
+		if header[241+patIdx] > 15 || header[369+patIdx] > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+/* Decodes a Composer 669 or UNIS 669 module. Each pattern has its own speed, which is set on its first row, and ends after its break row. */
+func Decode669(reader *bufio.Reader) (*Module, error) {
+	buff, e := ioutil.ReadAll(reader)
+	if e != nil {
+		return nil, e
+	}
+	if e := checkBounds("669", buff, 0, 497, "header"); e != nil {
+		return nil, e
+	}
+	m := NewModule()
+
+	/* The song message is three lines of 36 characters; the first is used as the name. */
+	m.songName = string(buff[2:38])
+	numSamples := int(buff[110])
+	m.numPatterns = int(buff[111])
+	m.numChannels = 8
+	m.c2Rate = NTSC
+	m.gain = 32
+	m.defaultGVol = 64
+	m.defaultTempo = 78
+	m.defaultPanning = make([]int, m.numChannels)
+	for idx := range m.defaultPanning {
+		m.defaultPanning[idx] = 0x30
+		if idx&1 == 1 {
+			m.defaultPanning[idx] = 0xD0
+		}
+	}
+	m.sequence = make([]int, 0, 128)
+	for seqIdx := 0; seqIdx < 128 && buff[113+seqIdx] != 0xFF; seqIdx++ {
+		m.sequence = append(m.sequence, int(buff[113+seqIdx]))
+	}
+	m.sequenceLength = len(m.sequence)
+	m.restartPos = int(buff[112])
+	if m.restartPos >= m.sequenceLength {
+		m.restartPos = 0
+	}
+	m.defaultSpeed = 6
+	if m.sequenceLength > 0 && m.sequence[0] < m.numPatterns && buff[241+m.sequence[0]] > 0 {
+		m.defaultSpeed = int(buff[241+m.sequence[0]])
+	}
+
+	offset := 497 + numSamples*25
+	if e := checkBounds("669", buff, 497, numSamples*25+m.numPatterns*1536, "patterns"); e != nil {
+		return nil, e
+	}
+	m.patterns = make([]*Pattern, m.numPatterns)
+	var noSpeed []int
+	for patIdx := range m.patterns {
+		pattern, speedSet := decode669Pattern(buff[offset:offset+1536], int(buff[241+patIdx]), int(buff[369+patIdx])+1)
+		m.patterns[patIdx] = pattern
+		offset += 1536
+		if !speedSet {
+			noSpeed = append(noSpeed, patIdx)
+		}
+	}
+	if len(noSpeed) > 0 {
+		/* Some patterns have an effect in every channel of their first row, so their speed goes in an extra channel. */
+		speedChannel := m.numChannels
+		m.SetNumChannels(speedChannel + 1)
+		for _, patIdx := range noSpeed {
+			m.patterns[patIdx].SetNote(0, speedChannel, Note{Effect: 0x0F, Param: int(buff[241+patIdx])})
+		}
+	}
+
+	m.numInstruments = numSamples
+	m.instruments = make([]*Instrument, numSamples+1)
+	m.instruments[0] = DefaultInstrument()
+	for insIdx := 1; insIdx <= numSamples; insIdx++ {
+		instrument := DefaultInstrument()
+		m.instruments[insIdx] = instrument
+		sample := instrument.samples[0]
+		header := buff[497+(insIdx-1)*25:]
+		instrument.name = string(header[0:13])
+		sample.name = instrument.name
+		sampleLength := int(binary.LittleEndian.Uint32(header[13:]))
+		loopStart := int(binary.LittleEndian.Uint32(header[17:]))
+		loopEnd := int(binary.LittleEndian.Uint32(header[21:]))
+		sample.volume = 64
+		sample.panning = -1
+		sample.c2Rate = m.c2Rate
+		if sampleLength < 0 || offset+sampleLength > len(buff) {
+			sampleLength = 0
+			if offset < len(buff) {
+				sampleLength = len(buff) - offset
+			}
+		}
+		sampleData := make([]int16, sampleLength)
+		for idx := range sampleData {
+			sampleData[idx] = int16(int(buff[offset+idx])-128) << 8
+		}
+		offset += sampleLength
+		/* A loop end past the end of the sample, usually 0xFFFFF, means no loop. */
+		loopLength := loopEnd - loopStart
+		if loopEnd > sampleLength || loopLength < 2 || loopStart < 0 {
+			loopStart = sampleLength
+			loopLength = 0
+		}
+		sample.setSampleData(sampleData, loopStart, loopLength, false)
+	}
+	if e := m.checkSequence("669"); e != nil {
+		return nil, e
+	}
+	return m, nil
+}
+
+/* Converts 64 rows of 8 channels of 3-byte notes. Slides, tone portamento and vibrato continue on later rows of the channel until the next note or command. The pattern speed is set in a free effect column of the first row if it has no speed command. Returns false if the first row has no free effect column. */
+func decode669Pattern(data []byte, speed, numRows int) (*Pattern, bool) {
+	pattern := NewPattern(8, numRows)
+	continued := make([]Note, 8)
+	speedSet := speed == 0
+	for row := 0; row < numRows; row++ {
+		for chanIdx := 0; chanIdx < 8; chanIdx++ {
+			cell := data[(row*8+chanIdx)*3:]
+			note := Note{}
+			if cell[0] < 0xFE {
+				note.Key = int(cell[0]>>2) + 25
+				note.Instrument = int(cell[0]&0x3)<<4 | int(cell[1]>>4) + 1
+			}
+			if cell[0] < 0xFF {
+				note.Volume = 0x10 + (int(cell[1]&0xF)*64+8)/15
+			}
+			if cell[2] != 0xFF {
+				convert669Effect(&note, int(cell[2]>>4), int(cell[2]&0xF))
+				continued[chanIdx] = Note{}
+				switch note.Effect {
+				case 0x40, 0x41, 0x42, 0x04:
+					continued[chanIdx] = note
+				}
+				if note.Effect == 0x0F && row == 0 {
+					speedSet = true
+				}
+			} else if note.Key > 0 {
+				continued[chanIdx] = Note{}
+			} else {
+				note.Effect, note.Param = continued[chanIdx].Effect, continued[chanIdx].Param
+			}
+			pattern.SetNote(row, chanIdx, note)
+		}
+	}
+	for chanIdx := 0; chanIdx < 8 && !speedSet; chanIdx++ {
+		if note := pattern.Note(0, chanIdx); note.Effect == 0 {
+			note.Effect, note.Param = 0x0F, speed
+			pattern.SetNote(0, chanIdx, note)
+			speedSet = true
+		}
+	}
+	return pattern, speedSet
+}
+
+func convert669Effect(note *Note, command, param int) {
+	switch command {
+	case 0: /* Frequency Slide Up. */
+		note.Effect, note.Param = 0x40, param
+	case 1: /* Frequency Slide Down. */
+		note.Effect, note.Param = 0x41, param
+	case 2: /* Frequency Tone Porta. */
+		note.Effect, note.Param = 0x42, param
+	case 3: /* Frequency Adjust. */
+		note.Effect, note.Param = 0x43, param
+	case 4: /* Vibrato. */
+		note.Effect, note.Param = 0x04, 0x80|param
+	case 5: /* Set Speed. */
+		if param > 0 {
+			note.Effect, note.Param = 0x0F, param
+		}
+	case 6: /* UNIS 669 Balance. */
+		note.Effect, note.Param = 0x08, param*17
+	case 7: /* UNIS 669 Retrig. */
+		if param > 0 {
+			note.Effect, note.Param = 0x1B, param
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package ibxmgo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+/* Returns a Composer 669 module with one sample and a pattern for each speed, each filled with cells from setup. */
+func module669(speeds []int, setup func(patIdx int, cell func(row, chanIdx int) []byte)) []byte {
+	buff := make([]byte, 497)
+	copy(buff, "ifcomposer")
+	buff[110], buff[111] = 1, byte(len(speeds))
+	for idx := 113; idx < 241; idx++ {
+		buff[idx] = 0xFF
+	}
+	for patIdx, speed := range speeds {
+		buff[113+patIdx] = byte(patIdx)
+		buff[241+patIdx] = byte(speed)
+		buff[369+patIdx] = 63
+	}
+	sample := make([]byte, 25)
+	copy(sample, "sample")
+	binary.LittleEndian.PutUint32(sample[13:], 10)
+	binary.LittleEndian.PutUint32(sample[21:], 0xFFFFF)
+	buff = append(buff, sample...)
+	for patIdx := range speeds {
+		data := bytes.Repeat([]byte{0xFF}, 1536)
+		setup(patIdx, func(row, chanIdx int) []byte {
+			return data[(row*8+chanIdx)*3:]
+		})
+		buff = append(buff, data...)
+	}
+	return append(buff, make([]byte, 10)...)
+}
+
+func TestDecode669PatternSpeed(t *testing.T) {
+	data := module669([]int{4, 5, 6, 7}, func(patIdx int, cell func(row, chanIdx int) []byte) {
+		switch patIdx {
+		case 0: /* A note without an effect on row 0. */
+			copy(cell(0, 0), []byte{24 << 2, 0x0F, 0xFF})
+		case 1: /* Effects in every channel of row 0 and a note on row 2. */
+			for chanIdx := 0; chanIdx < 8; chanIdx++ {
+				cell(0, chanIdx)[2] = 0x32
+			}
+			copy(cell(2, 0), []byte{24 << 2, 0x0F, 0xFF})
+		case 2: /* Notes with effects in every channel of row 0. */
+			for chanIdx := 0; chanIdx < 8; chanIdx++ {
+				copy(cell(0, chanIdx), []byte{24 << 2, 0x0F, 0x32})
+			}
+		case 3: /* A speed command on row 0. */
+			cell(0, 2)[2] = 0x53
+		}
+	})
+	m, e := Decode(bytes.NewReader(data))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if m.Format() != "669" || m.NumChannels() != 9 {
+		t.Fatalf("format %q with %d channels, want 669 with 9", m.Format(), m.NumChannels())
+	}
+	if panning := m.DefaultPanning(); panning[8] != 128 {
+		t.Errorf("extra channel panning %d, want 128", panning[8])
+	}
+	if sequence := m.Sequence(); !reflect.DeepEqual(sequence, []int{0, 1, 2, 3}) {
+		t.Errorf("sequence %v", sequence)
+	}
+	if m.DefaultSpeed() != 4 {
+		t.Errorf("default speed %d, want 4", m.DefaultSpeed())
+	}
+
+	note := Note{Key: 49, Instrument: 1, Volume: 0x50}
+	if text := note.Text("669"); !strings.HasPrefix(text, "C-2 ") {
+		t.Errorf("note 24 shown as %q, want C-2", text)
+	}
+	adjust := Note{Effect: 0x43, Param: 2}
+	noteAdjust := Note{Key: 49, Instrument: 1, Volume: 0x50, Effect: 0x43, Param: 2}
+	tests := []struct {
+		patIdx, row, chanIdx int
+		want                 Note
+	}{
+		{0, 0, 0, Note{Key: 49, Instrument: 1, Volume: 0x50, Effect: 0x0F, Param: 4}},
+		{0, 0, 1, Note{}},
+		{0, 0, 8, Note{}},
+		{1, 0, 0, adjust},
+		{1, 0, 7, adjust},
+		{1, 0, 8, Note{Effect: 0x0F, Param: 5}},
+		{1, 1, 0, Note{}},
+		{1, 1, 1, Note{}},
+		{1, 2, 0, note},
+		{2, 0, 0, noteAdjust},
+		{2, 0, 7, noteAdjust},
+		{2, 0, 8, Note{Effect: 0x0F, Param: 6}},
+		{2, 1, 0, Note{}},
+		{3, 0, 0, Note{}},
+		{3, 0, 2, Note{Effect: 0x0F, Param: 3}},
+		{3, 0, 8, Note{}},
+	}
+	for _, test := range tests {
+		if got := m.patterns[test.patIdx].Note(test.row, test.chanIdx); got != test.want {
+			t.Errorf("pattern %d row %d channel %d: %+v, want %+v", test.patIdx, test.row, test.chanIdx, got, test.want)
+		}
+	}
+}
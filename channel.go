@@ -1,5 +1,7 @@
 package ibxmgo
 
+import "math"
+
 type Interpolation int
 
 const (
@@ -54,11 +56,14 @@ var (
 )
 
 type Channel struct {
-	module     *Module
-	globalVol  *int
-	instrument *Instrument
-	sample     *Sample
-	keyOn      bool
+	module        *Module
+	globalVol     *int
+	events        *[]Event
+	instrument    *Instrument
+	sample        *Sample
+	keyOn         bool
+	noteOnPending bool
+	insIdx,
 	noteKey, noteIns, noteVol, noteEffect, noteParam,
 	sampleIdx, sampleFra, freq, ampl, pann,
 	volume, panning, fadeOutVol, volEnvTick, panEnvTick,
@@ -96,7 +101,7 @@ func (this *Channel) resample(outBuf []int32, offset, length, sampleRate int, in
 	step := (this.freq << (FP_SHIFT - 3)) / (sampleRate >> 3)
 	switch interpolation {
 	case NEAREST:
-		//this.sample.resampleNearest(this.sampleIdx, this.sampleFra, step, lAmpl, rAmpl, outBuf, offset, length)
+		this.sample.resampleNearest(this.sampleIdx, this.sampleFra, step, lAmpl, rAmpl, outBuf, offset, length)
 		break
 	case LINEAR:
 		this.sample.resampleLinear(this.sampleIdx, this.sampleFra, step, lAmpl, rAmpl, outBuf, offset, length)
@@ -267,7 +272,17 @@ func (this *Channel) tick() {
 		this.vibratoPhase += this.vibratoSpeed
 		this.vibrato(true)
 		break
+	case 0x40: /* Frequency Slide Up. */
+		this.frequencySlide(this.noteParam * 80)
+		break
+	case 0x41: /* Frequency Slide Down. */
+		this.frequencySlide(-this.noteParam * 80)
+		break
+	case 0x42: /* Frequency Tone Porta. */
+		this.frequencyPortamento(this.noteParam * 40)
+		break
 	}
+	this.flushNoteOn()
 	this.autoVibrato()
 	this.calculateFrequency()
 	this.calculateAmplitude()
@@ -275,11 +290,11 @@ func (this *Channel) tick() {
 }
 
 func (this *Channel) row(note *Note) {
-	this.noteKey = note.key
-	this.noteIns = note.instrument
-	this.noteVol = note.volume
-	this.noteEffect = note.effect
-	this.noteParam = note.param
+	this.noteKey = note.Key
+	this.noteIns = note.Instrument
+	this.noteVol = note.Volume
+	this.noteEffect = note.Effect
+	this.noteParam = note.Param
 	this.retrigCount++
 	this.vibratoAdd = 0
 	this.tremoloAdd = 0
@@ -392,6 +407,7 @@ func (this *Channel) row(note *Note) {
 		break
 	case 0x14: /* Key Off. */
 		this.keyOn = false
+		this.noteOff()
 		break
 	case 0x15: /* Set Envelope Tick. */
 		this.volEnvTick = this.noteParam & 0xFF
@@ -512,7 +528,11 @@ func (this *Channel) row(note *Note) {
 	case 0xF8: /* Set Panning. */
 		this.panning = this.noteParam * 17
 		break
+	case 0x43: /* Frequency Adjust. */
+		this.frequencySlide(this.noteParam * 80)
+		break
 	}
+	this.flushNoteOn()
 	this.autoVibrato()
 	this.calculateFrequency()
 	this.calculateAmplitude()
@@ -634,6 +654,57 @@ func (this *Channel) tonePortamento() {
 	}
 }
 
+/* Returns the frequency in Hz of a period, without vibrato or arpeggio. */
+func (this *Channel) periodToFreq(period int) float64 {
+	if this.module.linearPeriods {
+		return float64(NTSC) * math.Exp2(float64(4608-period)/768)
+	}
+	return float64(this.module.c2Rate) * 1712 / float64(period)
+}
+
+func (this *Channel) freqToPeriod(freq float64) int {
+	if freq < 1 {
+		freq = 1
+	}
+	period := 0.0
+	if this.module.linearPeriods {
+		period = 4608 - math.Log2(freq/float64(NTSC))*768
+	} else {
+		period = float64(this.module.c2Rate) * 1712 / freq
+	}
+	if period < 1 {
+		return 1
+	}
+	if period > 65535 {
+		return 65535
+	}
+	return int(period + 0.5)
+}
+
+/* Slide the frequency by delta Hz, for Composer 669 modules, which slide the sample rate rather than the period. */
+func (this *Channel) frequencySlide(delta int) {
+	if this.period > 0 {
+		this.period = this.freqToPeriod(this.periodToFreq(this.period) + float64(delta))
+	}
+}
+
+/* Slide the frequency by delta Hz towards the tone portamento target. */
+func (this *Channel) frequencyPortamento(delta int) {
+	if this.period > 0 && this.portaPeriod > 0 {
+		if this.period < this.portaPeriod {
+			this.frequencySlide(-delta)
+			if this.period > this.portaPeriod {
+				this.period = this.portaPeriod
+			}
+		} else {
+			this.frequencySlide(delta)
+			if this.period < this.portaPeriod {
+				this.period = this.portaPeriod
+			}
+		}
+	}
+}
+
 func (this *Channel) vibrato(fine bool) {
 	this.vibratoAdd = this.waveform(this.vibratoPhase, this.vibratoType&0x3) * this.vibratoDepth
 	if fine {
@@ -808,6 +879,7 @@ func (this *Channel) calculateAmplitude() {
 func (this *Channel) trigger() {
 	if this.noteIns > 0 && this.noteIns <= this.module.numInstruments {
 		this.instrument = this.module.instruments[this.noteIns]
+		this.insIdx = this.noteIns
 		k := 0
 		if this.noteKey < 97 {
 			k = this.noteKey
@@ -870,10 +942,11 @@ func (this *Channel) trigger() {
 	if this.noteKey > 0 {
 		if this.noteKey > 96 {
 			this.keyOn = false
+			this.noteOff()
 		} else {
 			isPorta := (this.noteVol&0xF0) == 0xF0 ||
 				this.noteEffect == 0x03 || this.noteEffect == 0x05 ||
-				this.noteEffect == 0x87 || this.noteEffect == 0x8C
+				this.noteEffect == 0x87 || this.noteEffect == 0x8C || this.noteEffect == 0x42
 			if !isPorta {
 				this.sample = this.instrument.samples[this.instrument.keyToSample[this.noteKey]]
 			}
@@ -898,9 +971,12 @@ func (this *Channel) trigger() {
 				x := tone & 0x7
 				y := ((m * x) >> 3) + c
 				this.portaPeriod = y >> uint(tone/768)
-				this.portaPeriod = int(this.module.c2Rate) * this.portaPeriod / int(this.sample.c2Rate)
+				if this.sample.c2Rate > 0 {
+					this.portaPeriod = int(this.module.c2Rate) * this.portaPeriod / int(this.sample.c2Rate)
+				}
 			}
 			if !isPorta {
+				this.noteOnPending = true
 				this.period = this.portaPeriod
 				this.sampleIdx = 0
 				this.sampleFra = 0
@@ -0,0 +1,156 @@
+/* Command modconv converts music modules between the formats ibxmgo can write. */
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vova616/ibxmgo"
+)
+
+var (
+	report = flag.Bool("report", false, "list features lost in conversion")
+	format = flag.String("format", "", "output format (xm, mod or s3m), default from the output file extension")
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: modconv [-report] [-format xm|mod|s3m] in out")
+	fmt.Fprintln(os.Stderr, "       modconv [-report] -format xm|mod|s3m indir outdir")
+	flag.PrintDefaults()
+}
+
+/* Converts the module in inPath to outPath and prints what was lost if requested. Files in an unknown format are skipped if skipUnknown is true, in which case false is returned. */
+func convert(inPath, outPath, outFormat string, skipUnknown bool) (bool, error) {
+	in, e := os.Open(inPath)
+	if e != nil {
+		return false, e
+	}
+	m, e := ibxmgo.Decode(in)
+	in.Close()
+	if e == ibxmgo.UnsupportedFormat && skipUnknown {
+		return false, nil
+	}
+	if e != nil {
+		return false, fmt.Errorf("%s: %v", inPath, e)
+	}
+	var out bytes.Buffer
+	lost, e := ibxmgo.Encode(&out, m, outFormat)
+	if e != nil {
+		return false, fmt.Errorf("%s: %v", inPath, e)
+	}
+	if *report {
+		for _, feature := range lost {
+			fmt.Printf("%s: lost %s\n", inPath, feature)
+		}
+	}
+	return true, ioutil.WriteFile(outPath, out.Bytes(), 0644)
+}
+
+/* Converts every file below inDir into the same place below outDir. Files that are not modules are skipped, as is outDir if it is below inDir. A file is not converted if its output would replace an input or the output of another file. */
+func convertDir(inDir, outDir, outFormat string) int {
+	failed := 0
+	inDir, e := filepath.Abs(inDir)
+	if e == nil {
+		outDir, e = filepath.Abs(outDir)
+	}
+	if e != nil {
+		fmt.Fprintln(os.Stderr, "modconv:", e)
+		return 1
+	}
+	written := make(map[string]string)
+	filepath.Walk(inDir, func(path string, info os.FileInfo, e error) error {
+		if e != nil {
+			fmt.Fprintln(os.Stderr, "modconv:", e)
+			failed++
+			return nil
+		}
+		if info.IsDir() {
+			if path == outDir && path != inDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, _ := filepath.Rel(inDir, path)
+		outPath := filepath.Join(outDir, strings.TrimSuffix(rel, filepath.Ext(rel))+"."+outFormat)
+		if outPath == path {
+			fmt.Fprintf(os.Stderr, "modconv: %s: output would replace the input\n", path)
+			failed++
+			return nil
+		}
+		if other, ok := written[outPath]; ok {
+			fmt.Fprintf(os.Stderr, "modconv: %s: output %s already written from %s\n", path, outPath, other)
+			failed++
+			return nil
+		}
+		if e := os.MkdirAll(filepath.Dir(outPath), 0755); e != nil {
+			fmt.Fprintln(os.Stderr, "modconv:", e)
+			failed++
+			return nil
+		}
+		converted, e := convert(path, outPath, outFormat, true)
+		if e != nil {
+			fmt.Fprintln(os.Stderr, "modconv:", e)
+			failed++
+		}
+		if converted {
+			written[outPath] = path
+		}
+		return nil
+	})
+	return failed
+}
+
+func checkFormat(outFormat string) error {
+	switch outFormat {
+	case "xm", "mod", "s3m":
+		return nil
+	}
+	return fmt.Errorf("unsupported output format %q", outFormat)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 2 {
+		usage()
+		os.Exit(2)
+	}
+	inPath, outPath := flag.Arg(0), flag.Arg(1)
+	outFormat := strings.ToLower(*format)
+	info, e := os.Stat(inPath)
+	if e != nil {
+		fmt.Fprintln(os.Stderr, "modconv:", e)
+		os.Exit(1)
+	}
+	if info.IsDir() {
+		if outFormat == "" {
+			fmt.Fprintln(os.Stderr, "modconv: -format is required when converting a directory")
+			os.Exit(2)
+		}
+		if e := checkFormat(outFormat); e != nil {
+			fmt.Fprintln(os.Stderr, "modconv:", e)
+			os.Exit(2)
+		}
+		if failed := convertDir(inPath, outPath, outFormat); failed > 0 {
+			fmt.Fprintf(os.Stderr, "modconv: %d files failed\n", failed)
+			os.Exit(1)
+		}
+		return
+	}
+	if outFormat == "" {
+		outFormat = strings.ToLower(strings.TrimPrefix(filepath.Ext(outPath), "."))
+	}
+	if e := checkFormat(outFormat); e != nil {
+		fmt.Fprintln(os.Stderr, "modconv:", e)
+		os.Exit(2)
+	}
+	if _, e := convert(inPath, outPath, outFormat, false); e != nil {
+		fmt.Fprintln(os.Stderr, "modconv:", e)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,198 @@
+/* Command modinfo prints a summary of music modules. */
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/vova616/ibxmgo"
+)
+
+var (
+	jsonOutput = flag.Bool("json", false, "print a JSON array with one object per module")
+	patterns   = flag.Bool("patterns", false, "include the pattern data as tracker text")
+)
+
+type sampleInfo struct {
+	Name       string `json:"name"`
+	Length     int    `json:"length"`
+	LoopMode   string `json:"loopMode"`
+	LoopStart  int    `json:"loopStart"`
+	LoopLength int    `json:"loopLength"`
+	Volume     int    `json:"volume"`
+}
+
+type instrumentInfo struct {
+	Number  int          `json:"number"`
+	Name    string       `json:"name"`
+	Samples []sampleInfo `json:"samples"`
+}
+
+type moduleInfo struct {
+	File          string           `json:"file"`
+	Format        string           `json:"format"`
+	Title         string           `json:"title"`
+	Channels      int              `json:"channels"`
+	Patterns      int              `json:"patterns"`
+	Sequence      []int            `json:"sequence"`
+	RestartPos    int              `json:"restartPos"`
+	Speed         int              `json:"speed"`
+	Tempo         int              `json:"tempo"`
+	LinearPeriods bool             `json:"linearPeriods"`
+	Duration      float64          `json:"duration"`    /* Seconds. */
+	RestartTime   float64          `json:"restartTime"` /* Seconds before the restart position is first reached. */
+	Instruments   []instrumentInfo `json:"instruments"`
+	PatternText   [][]string       `json:"patternText,omitempty"` /* One line per row for each pattern. */
+}
+
+/* Returns the loop of a sample with ping-pong loops folded back, as they are stored in module files. */
+func sampleLoop(sample *ibxmgo.Sample) (length int, mode string, loopStart, loopLength int) {
+	length = len(sample.Data())
+	loopStart, loopLength = sample.Loop()
+	switch {
+	case loopLength == 0:
+		return length, "none", 0, 0
+	case sample.PingPong():
+		loopLength /= 2
+		return loopStart + loopLength, "pingpong", loopStart, loopLength
+	}
+	return length, "forward", loopStart, loopLength
+}
+
+func inspect(path string) (*moduleInfo, error) {
+	in, e := os.Open(path)
+	if e != nil {
+		return nil, e
+	}
+	m, e := ibxmgo.Decode(in)
+	in.Close()
+	if e != nil {
+		return nil, fmt.Errorf("%s: %v", path, e)
+	}
+	ibxm, e := ibxmgo.NewIBXM(m, 48000)
+	if e != nil {
+		return nil, fmt.Errorf("%s: %v", path, e)
+	}
+	length := ibxm.SongLength()
+	info := &moduleInfo{
+		File:          path,
+		Format:        m.Format(),
+		Title:         m.Name(),
+		Channels:      m.NumChannels(),
+		Patterns:      len(m.Patterns()),
+		Sequence:      m.Sequence(),
+		RestartPos:    m.RestartPos(),
+		Speed:         m.DefaultSpeed(),
+		Tempo:         m.DefaultTempo(),
+		LinearPeriods: m.LinearPeriods(),
+		Duration:      length.Duration.Seconds(),
+		RestartTime:   length.LoopStartTime.Seconds(),
+		Instruments:   []instrumentInfo{},
+	}
+	for idx, instrument := range m.Instruments() {
+		instInfo := instrumentInfo{Number: idx + 1, Name: instrument.Name(), Samples: []sampleInfo{}}
+		for _, sample := range instrument.Samples() {
+			length, mode, loopStart, loopLength := sampleLoop(sample)
+			instInfo.Samples = append(instInfo.Samples, sampleInfo{
+				Name:       sample.Name(),
+				Length:     length,
+				LoopMode:   mode,
+				LoopStart:  loopStart,
+				LoopLength: loopLength,
+				Volume:     sample.Volume(),
+			})
+		}
+		info.Instruments = append(info.Instruments, instInfo)
+	}
+	if *patterns {
+		for _, pattern := range m.Patterns() {
+			text := strings.TrimSuffix(pattern.Text(m.Format()), "\n")
+			info.PatternText = append(info.PatternText, strings.Split(text, "\n"))
+		}
+	}
+	return info, nil
+}
+
+func printInfo(info *moduleInfo) {
+	periods := "amiga"
+	if info.LinearPeriods {
+		periods = "linear"
+	}
+	sequence := make([]string, len(info.Sequence))
+	for idx, pattern := range info.Sequence {
+		sequence[idx] = fmt.Sprint(pattern)
+	}
+	fmt.Println(info.File)
+	fmt.Printf("  format:      %s\n", info.Format)
+	fmt.Printf("  title:       %s\n", info.Title)
+	fmt.Printf("  channels:    %d\n", info.Channels)
+	fmt.Printf("  patterns:    %d\n", info.Patterns)
+	fmt.Printf("  instruments: %d\n", len(info.Instruments))
+	fmt.Printf("  sequence:    %s (restart at %d)\n", strings.Join(sequence, " "), info.RestartPos)
+	fmt.Printf("  speed/tempo: %d/%d\n", info.Speed, info.Tempo)
+	fmt.Printf("  periods:     %s\n", periods)
+	fmt.Printf("  duration:    %v (loops from %v)\n",
+		seconds(info.Duration), seconds(info.RestartTime))
+	for _, instrument := range info.Instruments {
+		fmt.Printf("  %3d %q\n", instrument.Number, instrument.Name)
+		for _, sample := range instrument.Samples {
+			if sample.Length == 0 && sample.Name == "" {
+				continue
+			}
+			fmt.Printf("        %q length %d", sample.Name, sample.Length)
+			if sample.LoopMode != "none" {
+				fmt.Printf(", %s loop %d+%d", sample.LoopMode, sample.LoopStart, sample.LoopLength)
+			}
+			fmt.Println()
+		}
+	}
+	for idx, rows := range info.PatternText {
+		fmt.Printf("  pattern %d\n", idx)
+		for _, row := range rows {
+			fmt.Printf("    %s\n", row)
+		}
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second)).Round(time.Millisecond)
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: modinfo [-json] [-patterns] file...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	failed := false
+	infos := []*moduleInfo{}
+	for _, path := range flag.Args() {
+		info, e := inspect(path)
+		if e != nil {
+			fmt.Fprintln(os.Stderr, "modinfo:", e)
+			failed = true
+			continue
+		}
+		if *jsonOutput {
+			infos = append(infos, info)
+		} else {
+			printInfo(info)
+		}
+	}
+	if *jsonOutput {
+		out := json.NewEncoder(os.Stdout)
+		out.SetIndent("", "  ")
+		out.Encode(infos)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
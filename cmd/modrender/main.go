@@ -0,0 +1,231 @@
+/* Command modrender renders music modules to WAV or raw audio files. */
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/vova616/ibxmgo"
+)
+
+var (
+	rate   = flag.Int("rate", 48000, "sample rate in Hz (8000 to 128000)")
+	interp = flag.String("interp", "linear", "interpolation (nearest, linear or sinc)")
+	loops  = flag.Int("loops", 1, "times to play the song")
+	fade   = flag.Duration("fade", 0, "fade out after the last loop, e.g. 5s")
+	start  = flag.Int("start", 0, "first sequence position to play")
+	end    = flag.Int("end", -1, "last sequence position to play, -1 for the end of the sequence")
+	mute   = flag.String("mute", "", "comma separated channels to mute, counting from 1")
+	solo   = flag.String("solo", "", "comma separated channels to play alone, counting from 1")
+	float  = flag.Bool("float", false, "write 32-bit float samples instead of 16-bit integers")
+	format = flag.String("format", "", "output format (wav or raw), default from the output file extension, wav if it is neither")
+	stems  = flag.Bool("stems", false, "write each channel to its own file, using out as a prefix")
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: modrender [options] in out")
+	flag.PrintDefaults()
+}
+
+func fail(code int, e error) {
+	fmt.Fprintln(os.Stderr, "modrender:", e)
+	os.Exit(code)
+}
+
+func parseInterpolation(name string) (ibxmgo.Interpolation, error) {
+	switch strings.ToLower(name) {
+	case "nearest":
+		return ibxmgo.NEAREST, nil
+	case "linear":
+		return ibxmgo.LINEAR, nil
+	case "sinc":
+		return ibxmgo.SINC, nil
+	}
+	return 0, fmt.Errorf("unsupported interpolation %q", name)
+}
+
+/* Parses a comma separated list of channel numbers counting from 1 and returns their indices. */
+func parseChannels(list string, numChannels int) ([]int, error) {
+	var channels []int
+	if list == "" {
+		return channels, nil
+	}
+	for _, field := range strings.Split(list, ",") {
+		channel, e := strconv.Atoi(strings.TrimSpace(field))
+		if e != nil || channel < 1 || channel > numChannels {
+			return nil, fmt.Errorf("invalid channel %q, the module has %d channels", field, numChannels)
+		}
+		channels = append(channels, channel-1)
+	}
+	return channels, nil
+}
+
+/* Output receives interleaved stereo audio from GetAudio or GetStems. */
+type output interface {
+	Write(data []int32) error
+	Close() error
+}
+
+/* Writes samples without a header through a buffer that is flushed on Close. */
+type rawOutput struct {
+	*ibxmgo.RawWriter
+	w *bufio.Writer
+}
+
+func (this *rawOutput) Close() error {
+	return this.w.Flush()
+}
+
+/* Creates the output file at path, returning the file to close once the output has been closed. */
+func createOutput(path, outFormat string, sampleRate int, sampleFormat ibxmgo.SampleFormat) (*os.File, output, error) {
+	file, e := os.Create(path)
+	if e != nil {
+		return nil, nil, e
+	}
+	if outFormat == "raw" {
+		w := bufio.NewWriter(file)
+		writer, e := ibxmgo.NewRawWriter(w, sampleFormat)
+		if e != nil {
+			file.Close()
+			return nil, nil, e
+		}
+		return file, &rawOutput{writer, w}, nil
+	}
+	writer, e := ibxmgo.NewWAVWriter(file, sampleRate, sampleFormat)
+	if e != nil {
+		file.Close()
+		return nil, nil, e
+	}
+	return file, writer, nil
+}
+
+func decode(path string) (*ibxmgo.Module, error) {
+	in, e := os.Open(path)
+	if e != nil {
+		return nil, e
+	}
+	defer in.Close()
+	m, e := ibxmgo.Decode(in)
+	if e != nil {
+		return nil, fmt.Errorf("%s: %v", path, e)
+	}
+	return m, nil
+}
+
+/* Renders the song to outputs, one for the mix or one per channel when stems are written. */
+func render(ibxm *ibxmgo.IBXM, outputs []output) error {
+	bufs := make([][]int32, len(outputs))
+	for idx := range bufs {
+		bufs[idx] = make([]int32, ibxm.AudioBufferLength())
+	}
+	for songEnd := false; !songEnd; {
+		var n int
+		if len(outputs) == 1 {
+			n, songEnd = ibxm.GetAudio(bufs[0])
+		} else {
+			n, songEnd = ibxm.GetStems(bufs)
+		}
+		for idx, out := range outputs {
+			if e := out.Write(bufs[idx][:n*2]); e != nil {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 2 {
+		usage()
+		os.Exit(2)
+	}
+	inPath, outPath := flag.Arg(0), flag.Arg(1)
+	outFormat := strings.ToLower(*format)
+	if outFormat == "" {
+		outFormat = strings.ToLower(strings.TrimPrefix(filepath.Ext(outPath), "."))
+		if outFormat != "raw" {
+			outFormat = "wav"
+		}
+	}
+	if outFormat != "wav" && outFormat != "raw" {
+		fail(2, fmt.Errorf("unsupported output format %q", outFormat))
+	}
+	interpolation, e := parseInterpolation(*interp)
+	if e != nil {
+		fail(2, e)
+	}
+	sampleFormat := ibxmgo.INT16
+	if *float {
+		sampleFormat = ibxmgo.FLOAT32
+	}
+	if *loops < 1 {
+		fail(2, fmt.Errorf("-loops %d would render forever", *loops))
+	}
+
+	m, e := decode(inPath)
+	if e != nil {
+		fail(1, e)
+	}
+	if *start < 0 || *start >= len(m.Sequence()) {
+		fail(2, fmt.Errorf("-start %d is outside the sequence of %d positions", *start, len(m.Sequence())))
+	}
+	if *end >= 0 && (*end < *start || *end >= len(m.Sequence())) {
+		fail(2, fmt.Errorf("-end %d is outside the sequence positions %d to %d", *end, *start, len(m.Sequence())-1))
+	}
+	ibxm, e := ibxmgo.NewIBXM(m, *rate)
+	if e != nil {
+		fail(2, fmt.Errorf("-rate %d: %v", *rate, e))
+	}
+	muted, e := parseChannels(*mute, ibxm.NumChannels())
+	if e != nil {
+		fail(2, e)
+	}
+	soloed, e := parseChannels(*solo, ibxm.NumChannels())
+	if e != nil {
+		fail(2, e)
+	}
+	ibxm.SetInterpolation(interpolation)
+	ibxm.SetLoopCount(*loops)
+	ibxm.SetFadeOut(*fade)
+	for _, chanIdx := range muted {
+		ibxm.SetChannelMute(chanIdx, true)
+	}
+	for _, chanIdx := range soloed {
+		ibxm.SetChannelSolo(chanIdx, true)
+	}
+	ibxm.SetSequenceRange(*start, *end)
+
+	paths := []string{outPath}
+	if *stems {
+		prefix := strings.TrimSuffix(outPath, filepath.Ext(outPath))
+		paths = make([]string, ibxm.NumChannels())
+		for chanIdx := range paths {
+			paths[chanIdx] = fmt.Sprintf("%s_ch%02d.%s", prefix, chanIdx+1, outFormat)
+		}
+	}
+	files := make([]*os.File, len(paths))
+	outputs := make([]output, len(paths))
+	for idx, path := range paths {
+		if files[idx], outputs[idx], e = createOutput(path, outFormat, *rate, sampleFormat); e != nil {
+			fail(1, e)
+		}
+	}
+	if e = render(ibxm, outputs); e != nil {
+		fail(1, e)
+	}
+	for idx, out := range outputs {
+		if e = out.Close(); e == nil {
+			e = files[idx].Close()
+		}
+		if e != nil {
+			fail(1, fmt.Errorf("%s: %v", paths[idx], e))
+		}
+	}
+}
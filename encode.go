@@ -0,0 +1,1210 @@
+package ibxmgo
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+/* EncodeError is returned when a module can not be written in a format. */
+type EncodeError struct {
+	Format string
+	Reason string
+}
+
+func (this *EncodeError) Error() string {
+	return fmt.Sprintf("%s: %s", this.Format, this.Reason)
+}
+
+/* Collects the features lost while encoding a module, each reported once. A nil report discards them. */
+type lossReport struct {
+	lost []string
+}
+
+func (this *lossReport) add(feature string) {
+	if this == nil {
+		return
+	}
+	for _, lost := range this.lost {
+		if lost == feature {
+			return
+		}
+	}
+	this.lost = append(this.lost, feature)
+}
+
+func appendLE16(buff []byte, value int) []byte {
+	return append(buff, byte(value), byte(value>>8))
+}
+
+func appendLE32(buff []byte, value int) []byte {
+	return append(buff, byte(value), byte(value>>8), byte(value>>16), byte(value>>24))
+}
+
+/* Appends name truncated or zero-padded to length bytes. */
+func appendName(buff []byte, name string, length int) []byte {
+	field := make([]byte, length)
+	copy(field, name)
+	return append(buff, field...)
+}
+
+/* Returns the sequence without entries that do not refer to a pattern, and the new position of each old position. */
+func playableSequence(m *Module) (sequence, seqMap []int) {
+	seqMap = make([]int, m.sequenceLength+1)
+	for seqPos := 0; seqPos < m.sequenceLength; seqPos++ {
+		seqMap[seqPos] = len(sequence)
+		if m.sequence[seqPos] < m.numPatterns {
+			sequence = append(sequence, m.sequence[seqPos])
+		}
+	}
+	seqMap[m.sequenceLength] = len(sequence)
+	return sequence, seqMap
+}
+
+/* Returns the position of a pattern jump target in a sequence produced by playableSequence. */
+func mapJump(seqMap []int, seqPos int) int {
+	if seqPos >= len(seqMap) {
+		seqPos = len(seqMap) - 1
+	}
+	return seqMap[seqPos]
+}
+
+/* Returns the data, loop and ping-pong flag of a sample with an unrolled ping-pong loop folded back. */
+func foldSample(sample *Sample) (data []int16, loopStart, loopLength int, pingPong bool) {
+	data = sample.Data()
+	loopStart, loopLength = sample.Loop()
+	if !sample.pingPong || !sample.looped() {
+		return data, loopStart, loopLength, false
+	}
+	half := loopLength / 2
+	return data[:loopStart+half], loopStart, half, true
+}
+
+/* Returns true if the sample can be stored with 8 bits per sample without loss. */
+func eightBit(data []int16) bool {
+	for _, ampl := range data {
+		if ampl&0xFF != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+/* Returns the relative note and fine tune of a sample, including its C2 rate when the module uses Amiga periods. */
+func sampleTune(m *Module, sample *Sample) (relNote, fineTune int) {
+	if m.linearPeriods || sample.c2Rate <= 0 || sample.c2Rate == NTSC {
+		return sample.relNote, sample.fineTune
+	}
+	tune := sample.relNote*128 + sample.fineTune
+	tune += int(math.Floor(math.Log2(float64(sample.c2Rate)/float64(NTSC))*12*128 + 0.5))
+	return tune >> 7, tune & 0x7F
+}
+
+/* Converts an effect in any of the internal numberings to an XM effect. */
+func xmEffect(effect, param int, seqMap []int, report *lossReport) (int, int) {
+	if effect < 0x40 {
+		if effect == 0x0B {
+			param = mapJump(seqMap, param)
+		}
+		return effect, param
+	}
+	switch effect {
+	case 0x81: /* Set Speed. */
+		if param > 0 && param < 32 {
+			return 0x0F, param
+		}
+		if param >= 32 {
+			report.add("speeds above 31")
+		}
+		return 0, 0
+	case 0x82: /* Pattern Jump. */
+		return 0x0B, mapJump(seqMap, param)
+	case 0x83: /* Pattern Break. */
+		return 0x0D, param
+	case 0x84: /* Vol Slide. */
+		if fineVolSlide(param) {
+			if param&0xF == 0xF {
+				return 0x0E, 0xA0 | param>>4
+			}
+			return 0x0E, 0xB0 | param&0xF
+		}
+		return 0x0A, param
+	case 0x85: /* Porta Down. */
+		if param >= 0xF0 {
+			return 0x0E, 0x20 | param&0xF
+		}
+		if param >= 0xE0 {
+			return 0x21, 0x20 | param&0xF
+		}
+		return 0x02, param
+	case 0x86: /* Porta Up. */
+		if param >= 0xF0 {
+			return 0x0E, 0x10 | param&0xF
+		}
+		if param >= 0xE0 {
+			return 0x21, 0x10 | param&0xF
+		}
+		return 0x01, param
+	case 0x87: /* Tone Porta. */
+		return 0x03, param
+	case 0x88: /* Vibrato. */
+		return 0x04, param
+	case 0x89: /* Tremor. */
+		return 0x1D, param
+	case 0x8A: /* Arpeggio. */
+		if param == 0 {
+			report.add("arpeggio without parameter")
+		}
+		return 0, param
+	case 0x8B: /* Vibrato + Vol Slide. */
+		if fineVolSlide(param) {
+			report.add("fine volume slides with vibrato or tone portamento")
+		}
+		return 0x06, param
+	case 0x8C: /* Tone Porta + Vol Slide. */
+		if fineVolSlide(param) {
+			report.add("fine volume slides with vibrato or tone portamento")
+		}
+		return 0x05, param
+	case 0x8F: /* Set Sample Offset. */
+		return 0x09, param
+	case 0x91: /* Retrig + Vol Slide. */
+		return 0x1B, param
+	case 0x92: /* Tremolo. */
+		return 0x07, param
+	case 0x93:
+		return xmExtendedEffect(param, report)
+	case 0x94: /* Set Tempo. */
+		if param > 32 {
+			return 0x0F, param
+		}
+		return 0, 0
+	case 0x95: /* Fine Vibrato. */
+		report.add("fine vibrato (approximated)")
+		depth := (param & 0xF) >> 2
+		if depth == 0 && param&0xF > 0 {
+			depth = 1
+		}
+		return 0x04, param&0xF0 | depth
+	case 0x96: /* Set Global Volume. */
+		return 0x10, param
+	case 0x40, 0x41, 0x42, 0x43:
+		report.add("669 frequency slides")
+		return 0, 0
+	}
+	report.add(fmt.Sprintf("effect %c", 'A'+effect-0x81))
+	return 0, 0
+}
+
+/* Returns true if an S3M volume slide parameter is a fine slide, DxF or DFx. */
+func fineVolSlide(param int) bool {
+	return (param&0xF == 0xF && param>>4 != 0) || (param>>4 == 0xF && param&0xF != 0)
+}
+
+/* Converts an S3M "S" effect to an XM "E" effect. */
+func xmExtendedEffect(param int, report *lossReport) (int, int) {
+	switch param >> 4 {
+	case 0x0:
+		return 0, 0
+	case 0x2: /* Set FineTune. */
+		return 0x0E, 0x50 | param&0xF
+	case 0x3: /* Set Vibrato Waveform. */
+		return 0x0E, 0x40 | param&0xF
+	case 0x4: /* Set Tremolo Waveform. */
+		return 0x0E, 0x70 | param&0xF
+	case 0x8: /* Set Panning. */
+		return 0x08, (param & 0xF) * 17
+	case 0xB: /* Pattern Loop. */
+		return 0x0E, 0x60 | param&0xF
+	case 0xC: /* Note Cut. */
+		return 0x0E, 0xC0 | param&0xF
+	case 0xD: /* Note Delay. */
+		return 0x0E, 0xD0 | param&0xF
+	case 0xE: /* Pattern Delay. */
+		return 0x0E, 0xE0 | param&0xF
+	}
+	report.add(fmt.Sprintf("effect S%X", param>>4))
+	return 0, 0
+}
+
+/* Appends the 12 points of an XM envelope and returns the point count, sustain, loop and flag bytes. */
+func appendXMEnvelope(buff []byte, env *Envelope, report *lossReport) ([]byte, []byte) {
+	numPoints := env.numPoints
+	if numPoints > 12 {
+		report.add("envelopes with more than 12 points")
+		numPoints = 12
+	}
+	for point := 0; point < 12; point++ {
+		tick, ampl := 0, 0
+		if point < numPoints {
+			tick, ampl = env.pointsTick[point], env.pointsAmpl[point]
+		}
+		if tick > 0xFFFF {
+			report.add("envelopes longer than 65535 ticks")
+			tick = 0xFFFF
+		}
+		buff = appendLE16(buff, tick)
+		buff = appendLE16(buff, ampl)
+	}
+	if numPoints < 1 {
+		/* An envelope without points is written disabled. */
+		return buff, make([]byte, 5)
+	}
+	pointIdx := func(tick int) byte {
+		idx := 0
+		for point := 0; point < numPoints; point++ {
+			if env.pointsTick[point] <= tick {
+				idx = point
+			}
+		}
+		if env.pointsTick[idx] != tick && env.enabled {
+			report.add("envelope sustain or loop between points")
+		}
+		return byte(idx)
+	}
+	flags := byte(0)
+	if env.enabled {
+		flags |= 0x1
+	}
+	if env.sustain {
+		flags |= 0x2
+	}
+	if env.looped {
+		flags |= 0x4
+	}
+	params := []byte{byte(numPoints), pointIdx(env.sustainTick),
+		pointIdx(env.loopStartTick), pointIdx(env.loopEndTick), flags}
+	return buff, params
+}
+
+/* Writes m as a FastTracker 2 XM file. */
+func EncodeXM(w io.Writer, m *Module) error {
+	return encodeXM(w, m, nil)
+}
+
+func encodeXM(w io.Writer, m *Module, report *lossReport) error {
+	sequence, seqMap := playableSequence(m)
+	if len(sequence) < 1 {
+		return &EncodeError{"xm", "no playable patterns in sequence"}
+	}
+	if len(sequence) > 256 {
+		return &EncodeError{"xm", "sequence longer than 256 entries"}
+	}
+	if m.numChannels < 1 || m.numChannels > 128 {
+		return &EncodeError{"xm", "invalid channel count"}
+	}
+	if m.numPatterns > 256 || m.numInstruments > 255 {
+		return &EncodeError{"xm", "too many patterns or instruments"}
+	}
+	if m.defaultGVol != 64 {
+		report.add("initial global volume")
+	}
+	if m.gain != 64 {
+		report.add("mixing gain")
+	}
+	if m.fastVolSlides {
+		report.add("fast volume slides")
+	}
+	for _, panning := range m.defaultPanning[:m.numChannels] {
+		if panning != 128 {
+			report.add("channel panning")
+		}
+	}
+	restartPos := mapJump(seqMap, m.restartPos)
+	if restartPos >= len(sequence) {
+		restartPos = 0
+	}
+
+	buff := append([]byte(nil), xmHeader...)
+	buff = appendName(buff, m.songName, 20)
+	buff = append(buff, 0x1A)
+	buff = appendName(buff, "ibxmgo", 20)
+	buff = appendLE16(buff, 0x0104)
+	buff = appendLE32(buff, 276)
+	buff = appendLE16(buff, len(sequence))
+	buff = appendLE16(buff, restartPos)
+	buff = appendLE16(buff, m.numChannels)
+	buff = appendLE16(buff, m.numPatterns)
+	buff = appendLE16(buff, m.numInstruments)
+	flags := 0
+	if m.linearPeriods {
+		flags |= 0x1
+	}
+	buff = appendLE16(buff, flags)
+	buff = appendLE16(buff, m.defaultSpeed)
+	buff = appendLE16(buff, m.defaultTempo)
+	orders := make([]byte, 256)
+	for seqPos, patIdx := range sequence {
+		orders[seqPos] = byte(patIdx)
+	}
+	buff = append(buff, orders...)
+
+	var note Note
+	for patIdx := 0; patIdx < m.numPatterns; patIdx++ {
+		pattern := m.patterns[patIdx]
+		if pattern.numRows < 1 || pattern.numRows > 256 {
+			return &EncodeError{"xm", fmt.Sprintf("pattern %d has %d rows", patIdx, pattern.numRows)}
+		}
+		var packed []byte
+		for noteIdx := 0; noteIdx < pattern.numRows*m.numChannels; noteIdx++ {
+			pattern.getNote(noteIdx, &note)
+			note.Effect, note.Param = xmEffect(note.Effect, note.Param, seqMap, report)
+			if note.Key > 97 {
+				report.add("note cut (as key off)")
+				note.Key = 97
+			}
+			fields := []int{note.Key, note.Instrument, note.Volume, note.Effect, note.Param}
+			mask := byte(0)
+			for idx, field := range fields {
+				if field != 0 {
+					mask |= 1 << uint(idx)
+				}
+			}
+			/* A full note may be stored without flags, unless its key would be read as flags. */
+			if mask != 0x1F || fields[0]&0x80 != 0 {
+				packed = append(packed, 0x80|mask)
+			}
+			for idx, field := range fields {
+				if mask&(1<<uint(idx)) != 0 {
+					packed = append(packed, byte(field))
+				}
+			}
+		}
+		if len(packed) == pattern.numRows*m.numChannels {
+			/* Every note is empty. */
+			packed = nil
+		}
+		if len(packed) > 0xFFFF {
+			return &EncodeError{"xm", fmt.Sprintf("pattern %d is too large", patIdx)}
+		}
+		buff = appendLE32(buff, 9)
+		buff = append(buff, 0)
+		buff = appendLE16(buff, pattern.numRows)
+		buff = appendLE16(buff, len(packed))
+		buff = append(buff, packed...)
+	}
+
+	for insIdx := 1; insIdx <= m.numInstruments; insIdx++ {
+		instrument := m.instruments[insIdx]
+		buff = appendLE32(buff, 263)
+		buff = appendName(buff, instrument.name, 22)
+		buff = append(buff, 0)
+		buff = appendLE16(buff, instrument.numSamples)
+		buff = appendLE32(buff, 40)
+		for key := 1; key <= 96; key++ {
+			buff = append(buff, byte(instrument.keyToSample[key]))
+		}
+		var volParams, panParams []byte
+		buff, volParams = appendXMEnvelope(buff, instrument.volumeEnvelope, report)
+		buff, panParams = appendXMEnvelope(buff, instrument.panningEnvelope, report)
+		buff = append(buff, volParams[0], panParams[0])
+		buff = append(buff, volParams[1:4]...)
+		buff = append(buff, panParams[1:4]...)
+		buff = append(buff, volParams[4], panParams[4])
+		buff = append(buff, byte(instrument.vibratoType), byte(instrument.vibratoSweep),
+			byte(instrument.vibratoDepth), byte(instrument.vibratoRate))
+		fadeOut := instrument.volumeFadeOut
+		if fadeOut > 0xFFFF {
+			report.add("volume fade out above 65535")
+			fadeOut = 0xFFFF
+		}
+		buff = appendLE16(buff, fadeOut)
+		buff = append(buff, make([]byte, 22)...)
+
+		var sampleData []byte
+		for _, sample := range instrument.samples[:instrument.numSamples] {
+			data, loopStart, loopLength, pingPong := foldSample(sample)
+			sampleType := byte(0)
+			if loopLength > 0 {
+				sampleType = 0x1
+				if pingPong {
+					sampleType = 0x2
+				}
+			}
+			bytesPerSample := 1
+			if !eightBit(data) {
+				sampleType |= 0x10
+				bytesPerSample = 2
+			}
+			panning := sample.panning
+			if panning < 0 {
+				panning = 128
+			}
+			relNote, fineTune := sampleTune(m, sample)
+			if relNote < -128 || relNote > 127 {
+				report.add("sample pitch out of range")
+			}
+			buff = appendLE32(buff, len(data)*bytesPerSample)
+			buff = appendLE32(buff, loopStart*bytesPerSample)
+			buff = appendLE32(buff, loopLength*bytesPerSample)
+			buff = append(buff, byte(sample.volume), byte(int8(fineTune)), sampleType,
+				byte(panning), byte(int8(relNote)), 0)
+			buff = appendName(buff, sample.name, 22)
+			if bytesPerSample == 2 {
+				ampl := int16(0)
+				for _, value := range data {
+					sampleData = appendLE16(sampleData, int(uint16(value-ampl)))
+					ampl = value
+				}
+			} else {
+				ampl := byte(0)
+				for _, value := range data {
+					sampleData = append(sampleData, byte(value>>8)-ampl)
+					ampl = byte(value >> 8)
+				}
+			}
+		}
+		buff = append(buff, sampleData...)
+	}
+	_, e := w.Write(buff)
+	return e
+}
+
+/* ProTracker periods of keys 25 to 84. */
+var modPeriods = []int{
+	1712, 1616, 1525, 1440, 1357, 1281, 1209, 1141, 1077, 1017, 961, 907,
+	856, 808, 762, 720, 678, 640, 604, 570, 538, 508, 480, 453,
+	428, 404, 381, 360, 339, 320, 302, 285, 269, 254, 240, 226,
+	214, 202, 190, 180, 170, 160, 151, 143, 135, 127, 120, 113,
+	107, 101, 95, 90, 85, 80, 76, 71, 67, 64, 60, 57,
+}
+
+/* Returns the Amiga period of key, or 0 if the key can not be stored in a MOD pattern. */
+func modPeriod(key int) int {
+	if key < 1 || key > 96 {
+		return 0
+	}
+	oct := (key - 1) / 12
+	period := ((keyToPeriod[(key-1)%12+1] >> uint(oct)) + 2) / 4
+	if key >= 25 && key < 25+len(modPeriods) {
+		period = modPeriods[key-25]
+	}
+	if period > 0xFFF || periodToKey(period) != key {
+		return 0
+	}
+	return period
+}
+
+/* Returns the MOD fine tune (-8 to 7) of a sample and the number of semitones notes must be transposed by. */
+func modTune(m *Module, sample *Sample, c2Rate C2Rate) (fineTune, transpose int) {
+	rate := sample.c2Rate
+	if m.linearPeriods || rate <= 0 {
+		rate = NTSC
+	}
+	tune := sample.relNote*128 + sample.fineTune
+	tune += int(math.Floor(math.Log2(float64(rate)/float64(c2Rate))*12*128 + 0.5))
+	transpose = (tune + 64) >> 7
+	fineTune = int(math.Floor(float64(tune-transpose*128)/16 + 0.5))
+	return fineTune, transpose
+}
+
+/* Converts an effect in any of the internal numberings to a MOD effect. */
+func modEffect(effect, param, numChannels int, seqMap []int, report *lossReport) (int, int) {
+	effect, param = xmEffect(effect, param, seqMap, report)
+	if effect > 0xF {
+		report.add(fmt.Sprintf("effect %c", 'A'+effect-10))
+		return 0, 0
+	}
+	/* These are changed by DecodeMOD as ProTracker has no effect memory. */
+	if param == 0 && (effect == 0x1 || effect == 0x2 || effect == 0xA) {
+		report.add("effects without parameter")
+		return 0, 0
+	}
+	if param == 0 && (effect == 0x5 || effect == 0x6) {
+		report.add("effects without parameter")
+		return effect - 2, 0
+	}
+	if effect == 0x8 && numChannels == 4 {
+		report.add("panning in 4-channel modules")
+		return 0, 0
+	}
+	return effect, param
+}
+
+/* Writes m as a 31-instrument ProTracker MOD file. Samples are reduced to 8 bits. */
+func EncodeMOD(w io.Writer, m *Module) error {
+	return encodeMOD(w, m, nil)
+}
+
+func encodeMOD(w io.Writer, m *Module, report *lossReport) error {
+	sequence, seqMap := playableSequence(m)
+	if len(sequence) < 1 {
+		return &EncodeError{"mod", "no playable patterns in sequence"}
+	}
+	if len(sequence) > 128 {
+		return &EncodeError{"mod", "sequence longer than 128 entries"}
+	}
+	if m.numChannels < 1 || m.numChannels > 99 {
+		return &EncodeError{"mod", "channel count must be 1 to 99"}
+	}
+	if m.numPatterns > 128 {
+		return &EncodeError{"mod", "more than 128 patterns"}
+	}
+	if m.numInstruments > 31 {
+		return &EncodeError{"mod", "more than 31 instruments"}
+	}
+	for patIdx, pattern := range m.patterns[:m.numPatterns] {
+		if pattern.numRows != 64 {
+			return &EncodeError{"mod", fmt.Sprintf("pattern %d does not have 64 rows", patIdx)}
+		}
+	}
+	c2Rate, gain := NTSC, 32
+	if m.numChannels == 4 {
+		c2Rate, gain = PAL, 64
+	}
+	fineTunes := make([]int, m.numInstruments+1)
+	transposes := make([]int, m.numInstruments+1)
+	for insIdx := 1; insIdx <= m.numInstruments; insIdx++ {
+		instrument := m.instruments[insIdx]
+		if instrument.numSamples > 1 {
+			return &EncodeError{"mod", fmt.Sprintf("instrument %d has more than one sample", insIdx)}
+		}
+		if instrument.volumeEnvelope.enabled || instrument.panningEnvelope.enabled {
+			return &EncodeError{"mod", fmt.Sprintf("instrument %d has envelopes", insIdx)}
+		}
+		if instrument.vibratoDepth > 0 {
+			return &EncodeError{"mod", fmt.Sprintf("instrument %d has auto-vibrato", insIdx)}
+		}
+		sample := instrument.samples[0]
+		if len(sample.Data()) > 0x1FFFE {
+			return &EncodeError{"mod", fmt.Sprintf("sample of instrument %d is too long", insIdx)}
+		}
+		if sample.panning >= 0 {
+			report.add("sample panning")
+		}
+		fineTunes[insIdx], transposes[insIdx] = modTune(m, sample, c2Rate)
+	}
+	if m.linearPeriods {
+		report.add("linear frequency slides")
+	}
+	if m.defaultGVol != 64 {
+		report.add("initial global volume")
+	}
+	if m.gain != gain {
+		report.add("mixing gain")
+	}
+	if m.fastVolSlides {
+		report.add("fast volume slides")
+	}
+	for chanIdx, panning := range m.defaultPanning[:m.numChannels] {
+		amigaPanning := 51
+		if chanIdx&3 == 1 || chanIdx&3 == 2 {
+			amigaPanning = 204
+		}
+		if panning != amigaPanning {
+			report.add("channel panning")
+		}
+	}
+	restartPos := mapJump(seqMap, m.restartPos)
+	if restartPos >= len(sequence) {
+		restartPos = 0
+	}
+	/* Patterns are stored up to the highest index in the order table. */
+	orders := make([]byte, 128)
+	numPatterns := 0
+	for seqPos, patIdx := range sequence {
+		orders[seqPos] = byte(patIdx)
+		if patIdx >= numPatterns {
+			numPatterns = patIdx + 1
+		}
+	}
+	if numPatterns < m.numPatterns {
+		if len(sequence) < 128 {
+			orders[len(sequence)] = byte(m.numPatterns - 1)
+			numPatterns = m.numPatterns
+		} else {
+			report.add("patterns not in the sequence")
+		}
+	}
+	/* The initial speed and tempo are written into the first pattern, so it is copied if it is played again. */
+	patterns := append([]*Pattern(nil), m.patterns[:numPatterns]...)
+	initialPattern := sequence[0]
+	if (m.defaultSpeed != 6 && m.defaultSpeed < 32) || m.defaultTempo != 125 {
+		for _, patIdx := range sequence[1:] {
+			if patIdx != sequence[0] {
+				continue
+			}
+			if numPatterns < 128 {
+				initialPattern = numPatterns
+				sequence = append([]int{numPatterns}, sequence[1:]...)
+				orders[0] = byte(numPatterns)
+				patterns = append(patterns, m.patterns[patIdx])
+				numPatterns++
+			} else {
+				report.add("initial speed and tempo")
+				initialPattern = -1
+			}
+			break
+		}
+	}
+
+	buff := appendName(nil, m.songName, 20)
+	for insIdx := 1; insIdx <= 31; insIdx++ {
+		if insIdx > m.numInstruments {
+			buff = append(buff, make([]byte, 22)...)
+			buff = append(buff, 0, 0, 0, 0, 0, 0, 0, 1)
+			continue
+		}
+		instrument := m.instruments[insIdx]
+		sample := instrument.samples[0]
+		data := sample.Data()
+		loopStart, loopLength := sample.Loop()
+		if loopStart&1 != 0 || loopLength&1 != 0 {
+			report.add("odd loop points")
+			loopStart, loopLength = loopStart&^1, loopLength&^1
+		}
+		if loopLength > 0 && loopLength < 4 {
+			report.add("loops shorter than 4 samples")
+		}
+		if loopLength < 4 {
+			loopStart, loopLength = 0, 2
+		}
+		volume := sample.volume
+		if volume > 64 {
+			volume = 64
+		}
+		buff = appendName(buff, instrument.name, 22)
+		buff = append(buff, byte((len(data)+1)>>9), byte((len(data)+1)>>1))
+		buff = append(buff, byte(fineTunes[insIdx]&0xF), byte(volume))
+		buff = append(buff, byte(loopStart>>9), byte(loopStart>>1))
+		buff = append(buff, byte(loopLength>>9), byte(loopLength>>1))
+	}
+	buff = append(buff, byte(len(sequence)), byte(restartPos))
+	buff = append(buff, orders...)
+	switch {
+	case m.numChannels == 4 && numPatterns > 64:
+		buff = append(buff, "M!K!"...)
+	case m.numChannels == 4:
+		buff = append(buff, "M.K."...)
+	case m.numChannels < 10:
+		buff = append(buff, byte('0'+m.numChannels), 'C', 'H', 'N')
+	default:
+		buff = append(buff, byte('0'+m.numChannels/10), byte('0'+m.numChannels%10), 'C', 'H')
+	}
+
+	/* Follow the sequence to find the instrument playing notes without an instrument. */
+	startIns := make([][]int, numPatterns)
+	chanIns := make([]int, m.numChannels)
+	var note Note
+	for _, patIdx := range sequence {
+		pattern := patterns[patIdx]
+		if startIns[patIdx] == nil {
+			startIns[patIdx] = append([]int(nil), chanIns...)
+		}
+		for noteIdx := 0; noteIdx < pattern.numRows*m.numChannels; noteIdx++ {
+			pattern.getNote(noteIdx, &note)
+			if note.Instrument > 0 {
+				chanIns[noteIdx%m.numChannels] = note.Instrument
+			}
+		}
+	}
+	for patIdx, pattern := range patterns {
+		copy(chanIns, startIns[patIdx])
+		if startIns[patIdx] == nil {
+			for idx := range chanIns {
+				chanIns[idx] = 0
+			}
+		}
+		/* The initial speed and tempo are set in free effect columns of the first row played. */
+		var initial []int
+		if patIdx == initialPattern {
+			if m.defaultSpeed >= 32 {
+				report.add("speeds above 31")
+			} else if m.defaultSpeed != 6 {
+				initial = append(initial, m.defaultSpeed)
+			}
+			if m.defaultTempo != 125 {
+				initial = append(initial, m.defaultTempo)
+			}
+		}
+		for noteIdx := 0; noteIdx < pattern.numRows*m.numChannels; noteIdx++ {
+			pattern.getNote(noteIdx, &note)
+			chanIdx := noteIdx % m.numChannels
+			if note.Instrument > 0 {
+				chanIns[chanIdx] = note.Instrument
+			}
+			period := 0
+			if note.Key > 96 {
+				report.add("key off")
+			} else if note.Key > 0 {
+				key := note.Key
+				if chanIns[chanIdx] <= m.numInstruments {
+					key += transposes[chanIns[chanIdx]]
+				}
+				if period = modPeriod(key); period == 0 {
+					report.add("notes outside the Amiga period range")
+				}
+			}
+			effect, param := modEffect(note.Effect, note.Param, m.numChannels, seqMap, report)
+			if note.Volume >= 0x10 && note.Volume <= 0x50 && effect == 0 && param == 0 {
+				effect, param = 0xC, note.Volume-0x10
+			} else if note.Volume != 0 {
+				report.add("volume column")
+			}
+			if noteIdx < m.numChannels && len(initial) > 0 && effect == 0 && param == 0 {
+				effect, param = 0xF, initial[0]
+				initial = initial[1:]
+			}
+			buff = append(buff, byte(note.Instrument&0x10|period>>8), byte(period),
+				byte((note.Instrument&0xF)<<4|effect), byte(param))
+		}
+		if len(initial) > 0 {
+			report.add("initial speed and tempo")
+		}
+	}
+
+	for insIdx := 1; insIdx <= m.numInstruments; insIdx++ {
+		data := m.instruments[insIdx].samples[0].Data()
+		if !eightBit(data) {
+			report.add("16-bit samples")
+		}
+		for _, ampl := range data {
+			buff = append(buff, byte(ampl>>8))
+		}
+		if len(data)&1 != 0 {
+			buff = append(buff, 0)
+		}
+	}
+	_, e := w.Write(buff)
+	return e
+}
+
+/* Converts the effect of a note in any of the internal numberings to an S3M effect. The key and volume column may also be changed. */
+func s3mEffect(note *Note, seqMap []int, report *lossReport) {
+	effect, param := note.Effect, note.Param
+	note.Effect, note.Param = 0, 0
+	if effect >= 0x80 {
+		if effect == 0x82 {
+			param = mapJump(seqMap, param)
+		}
+		if effect < 0xC0 {
+			note.Effect, note.Param = effect, param
+		}
+		return
+	}
+	switch effect {
+	case 0x00:
+		if param > 0 {
+			note.Effect, note.Param = 0x8A, param
+		}
+	case 0x01:
+		note.Effect, note.Param = 0x86, param
+	case 0x02:
+		note.Effect, note.Param = 0x85, param
+	case 0x03:
+		note.Effect, note.Param = 0x87, param
+	case 0x04:
+		note.Effect, note.Param = 0x88, param
+	case 0x05:
+		note.Effect, note.Param = 0x8C, param
+	case 0x06:
+		note.Effect, note.Param = 0x8B, param
+	case 0x07:
+		note.Effect, note.Param = 0x92, param
+	case 0x08:
+		if param%17 != 0 {
+			report.add("panning rounded to 16 positions")
+		}
+		note.Effect, note.Param = 0x93, 0x80|(param+8)/17
+	case 0x09:
+		note.Effect, note.Param = 0x8F, param
+	case 0x0A:
+		note.Effect, note.Param = 0x84, param
+	case 0x0B:
+		note.Effect, note.Param = 0x82, mapJump(seqMap, param)
+	case 0x0C:
+		if note.Volume == 0 {
+			if param > 64 {
+				param = 64
+			}
+			note.Volume = 0x10 + param
+		} else {
+			report.add("set volume effects with a volume column")
+		}
+	case 0x0D:
+		note.Effect, note.Param = 0x83, param
+	case 0x0E:
+		s3mExtendedEffect(note, param, report)
+	case 0x0F:
+		if param > 0 && param < 32 {
+			note.Effect, note.Param = 0x81, param
+		} else if param > 32 {
+			note.Effect, note.Param = 0x94, param
+		} else if param == 32 {
+			report.add("tempo 32")
+		}
+	case 0x10:
+		note.Effect, note.Param = 0x96, param
+	case 0x14:
+		if param == 0 && note.Key == 0 {
+			note.Key = 97
+		} else {
+			report.add("delayed key off")
+		}
+	case 0x1B:
+		note.Effect, note.Param = 0x91, param
+	case 0x1D:
+		note.Effect, note.Param = 0x89, param
+	case 0x21:
+		switch param >> 4 {
+		case 0x1:
+			note.Effect, note.Param = 0x86, 0xE0|param&0xF
+		case 0x2:
+			note.Effect, note.Param = 0x85, 0xE0|param&0xF
+		default:
+			report.add("effect X")
+		}
+	case 0x40, 0x41, 0x42, 0x43:
+		report.add("669 frequency slides")
+	default:
+		report.add(fmt.Sprintf("effect %c", 'A'+effect-10))
+	}
+}
+
+/* Converts an XM "E" effect to an S3M effect. */
+func s3mExtendedEffect(note *Note, param int, report *lossReport) {
+	x := param & 0xF
+	switch param >> 4 {
+	case 0x1: /* Fine Porta Up. */
+		if x > 0 {
+			note.Effect, note.Param = 0x86, 0xF0|x
+			return
+		}
+	case 0x2: /* Fine Porta Down. */
+		if x > 0 {
+			note.Effect, note.Param = 0x85, 0xF0|x
+			return
+		}
+	case 0x4: /* Set Vibrato Waveform. */
+		note.Effect, note.Param = 0x93, 0x30|x
+		return
+	case 0x5: /* Set FineTune. */
+		note.Effect, note.Param = 0x93, 0x20|x
+		return
+	case 0x6: /* Pattern Loop. */
+		note.Effect, note.Param = 0x93, 0xB0|x
+		return
+	case 0x7: /* Set Tremolo Waveform. */
+		note.Effect, note.Param = 0x93, 0x40|x
+		return
+	case 0x9: /* Retrig. */
+		note.Effect, note.Param = 0x91, x
+		return
+	case 0xA: /* Fine Vol Slide Up. */
+		if x > 0 && x < 0xF {
+			note.Effect, note.Param = 0x84, x<<4|0xF
+			return
+		}
+	case 0xB: /* Fine Vol Slide Down. */
+		if x > 0 && x < 0xF {
+			note.Effect, note.Param = 0x84, 0xF0|x
+			return
+		}
+	case 0xC: /* Note Cut. */
+		note.Effect, note.Param = 0x93, 0xC0|x
+		return
+	case 0xD: /* Note Delay. */
+		note.Effect, note.Param = 0x93, 0xD0|x
+		return
+	case 0xE: /* Pattern Delay. */
+		note.Effect, note.Param = 0x93, 0xE0|x
+		return
+	}
+	report.add(fmt.Sprintf("effect E%X", param>>4))
+}
+
+/* Moves volume column slides to the effect column, as S3M volume columns only set the volume. */
+func s3mVolume(note *Note, report *lossReport) {
+	if note.Volume == 0 || (note.Volume >= 0x10 && note.Volume <= 0x50) {
+		return
+	}
+	x := note.Volume & 0xF
+	effect, param := 0, 0
+	switch note.Volume & 0xF0 {
+	case 0x60: /* Vol Slide Down. */
+		effect, param = 0x84, x
+	case 0x70: /* Vol Slide Up. */
+		effect, param = 0x84, x<<4
+	case 0x80: /* Fine Vol Slide Down. */
+		effect, param = 0x84, 0xF0|x
+	case 0x90: /* Fine Vol Slide Up. */
+		effect, param = 0x84, x<<4|0xF
+	}
+	if effect == 0 || x == 0 || x == 0xF || note.Effect != 0 {
+		report.add("volume column effects")
+	} else {
+		note.Effect, note.Param = effect, param
+	}
+	note.Volume = 0
+}
+
+/* Returns the C2 rate of a sample with its relative note and fine tune applied. */
+func s3mC2Rate(m *Module, sample *Sample) int {
+	rate := sample.c2Rate
+	if m.linearPeriods || rate <= 0 {
+		rate = NTSC
+	}
+	tune := float64(sample.relNote*128 + sample.fineTune)
+	return int(math.Floor(float64(rate)*math.Pow(2, tune/1536) + 0.5))
+}
+
+/* Writes m as a Scream Tracker 3 S3M file with unsigned samples. */
+func EncodeS3M(w io.Writer, m *Module) error {
+	return encodeS3M(w, m, nil)
+}
+
+func encodeS3M(w io.Writer, m *Module, report *lossReport) error {
+	sequence, seqMap := playableSequence(m)
+	if len(sequence) < 1 {
+		return &EncodeError{"s3m", "no playable patterns in sequence"}
+	}
+	if len(sequence) > 256 {
+		return &EncodeError{"s3m", "sequence longer than 256 entries"}
+	}
+	if m.numChannels < 1 || m.numChannels > 16 {
+		return &EncodeError{"s3m", "channel count must be 1 to 16"}
+	}
+	if m.numPatterns > 254 || m.numInstruments > 255 {
+		return &EncodeError{"s3m", "too many patterns or instruments"}
+	}
+	for patIdx, pattern := range m.patterns[:m.numPatterns] {
+		if pattern.numRows > 64 {
+			return &EncodeError{"s3m", fmt.Sprintf("pattern %d has more than 64 rows", patIdx)}
+		}
+	}
+	if m.linearPeriods {
+		report.add("linear frequency slides")
+	}
+	if m.gain > 127 {
+		report.add("mixing gain above 127")
+	}
+	for _, panning := range m.defaultPanning[:m.numChannels] {
+		if panning%17 != 0 {
+			report.add("panning rounded to 16 positions")
+		}
+	}
+	/* ScreamTracker expects an even number of orders. */
+	numOrders := len(sequence) + len(sequence)&1
+
+	buff := appendName(nil, m.songName, 28)
+	buff = append(buff, 0x1A, 16, 0, 0)
+	buff = appendLE16(buff, numOrders)
+	buff = appendLE16(buff, m.numInstruments)
+	buff = appendLE16(buff, m.numPatterns)
+	flags := 0
+	if m.fastVolSlides {
+		flags |= 0x40
+	}
+	buff = appendLE16(buff, flags)
+	buff = appendLE16(buff, 0x1320)
+	buff = appendLE16(buff, 2)
+	buff = append(buff, "SCRM"...)
+	gain := m.gain
+	if gain > 127 {
+		gain = 127
+	}
+	buff = append(buff, byte(m.defaultGVol), byte(m.defaultSpeed), byte(m.defaultTempo), byte(0x80|gain), 0, 0xFC)
+	buff = append(buff, make([]byte, 10)...)
+	/* Each channel needs its own PCM channel, L1 to L8 (0 to 7) or R1 to R8 (8 to 15). A side that is full takes from the other, as the panning table sets the position. */
+	nextSetting := []int{0, 8}
+	for chanIdx := 0; chanIdx < 32; chanIdx++ {
+		setting := 0xFF
+		if chanIdx < m.numChannels {
+			side := 0
+			if m.defaultPanning[chanIdx] >= 128 {
+				side = 1
+			}
+			if nextSetting[side] >= side*8+8 {
+				side ^= 1
+			}
+			setting = nextSetting[side]
+			nextSetting[side]++
+		}
+		buff = append(buff, byte(setting))
+	}
+	for seqPos := 0; seqPos < numOrders; seqPos++ {
+		patIdx := 0xFF
+		if seqPos < len(sequence) {
+			patIdx = sequence[seqPos]
+		}
+		buff = append(buff, byte(patIdx))
+	}
+	insPointers := len(buff)
+	buff = append(buff, make([]byte, (m.numInstruments+m.numPatterns)*2)...)
+	patPointers := insPointers + m.numInstruments*2
+	for chanIdx := 0; chanIdx < 32; chanIdx++ {
+		panning := byte(0)
+		if chanIdx < m.numChannels {
+			panning = 0x20 | byte((m.defaultPanning[chanIdx]+8)/17)
+		}
+		buff = append(buff, panning)
+	}
+	align := func() (int, error) {
+		for len(buff)&0xF != 0 {
+			buff = append(buff, 0)
+		}
+		if len(buff) > 0xFFFF0 {
+			return 0, &EncodeError{"s3m", "module too large"}
+		}
+		return len(buff) >> 4, nil
+	}
+
+	samples := make([]*Sample, m.numInstruments+1)
+	sampleHeaders := make([]int, m.numInstruments+1)
+	for insIdx := 1; insIdx <= m.numInstruments; insIdx++ {
+		instrument := m.instruments[insIdx]
+		if instrument.volumeEnvelope.enabled || instrument.panningEnvelope.enabled {
+			report.add("envelopes")
+		}
+		if instrument.vibratoDepth > 0 {
+			report.add("instrument auto-vibrato")
+		}
+		if instrument.numSamples > 1 {
+			report.add("instruments with several samples")
+		}
+		sample := instrument.samples[instrument.keyToSample[49]]
+		samples[insIdx] = sample
+		if sample.panning >= 0 {
+			report.add("sample panning")
+		}
+		pointer, e := align()
+		if e != nil {
+			return e
+		}
+		buff[insPointers+insIdx*2-2] = byte(pointer)
+		buff[insPointers+insIdx*2-1] = byte(pointer >> 8)
+		sampleHeaders[insIdx] = len(buff)
+		data := sample.Data()
+		loopStart, loopLength := sample.Loop()
+		header := make([]byte, 80)
+		if len(data) > 0 || sample.c2Rate > 0 {
+			header[0] = 1
+			copy(header[16:], appendLE32(nil, len(data)))
+			copy(header[20:], appendLE32(nil, loopStart))
+			copy(header[24:], appendLE32(nil, loopStart+loopLength))
+			volume := sample.volume
+			if volume > 64 {
+				volume = 64
+			}
+			header[28] = byte(volume)
+			if loopLength > 0 {
+				header[31] |= 0x1
+			}
+			if !eightBit(data) {
+				header[31] |= 0x4
+			}
+			copy(header[32:], appendLE32(nil, s3mC2Rate(m, sample)))
+			copy(header[76:], "SCRS")
+		}
+		copy(header[48:76], instrument.name)
+		buff = append(buff, header...)
+	}
+
+	var note Note
+	for patIdx := 0; patIdx < m.numPatterns; patIdx++ {
+		pattern := m.patterns[patIdx]
+		pointer, e := align()
+		if e != nil {
+			return e
+		}
+		buff[patPointers+patIdx*2] = byte(pointer)
+		buff[patPointers+patIdx*2+1] = byte(pointer >> 8)
+		start := len(buff)
+		buff = append(buff, 0, 0)
+		for row := 0; row < 64; row++ {
+			/* Shorter patterns end with a pattern break. */
+			needBreak := row == pattern.numRows-1 && pattern.numRows < 64
+			for chanIdx := 0; chanIdx < m.numChannels; chanIdx++ {
+				note = Note{}
+				if row < pattern.numRows {
+					pattern.getNote(row*m.numChannels+chanIdx, &note)
+				}
+				s3mEffect(&note, seqMap, report)
+				s3mVolume(&note, report)
+				if needBreak && note.Effect == 0 {
+					note.Effect, note.Param = 0x83, 0
+					needBreak = false
+				}
+				token := byte(chanIdx)
+				if note.Key > 0 || note.Instrument > 0 {
+					token |= 0x20
+				}
+				if note.Volume > 0 {
+					token |= 0x40
+				}
+				if note.Effect > 0 {
+					token |= 0x80
+				}
+				if token&0xE0 == 0 {
+					continue
+				}
+				buff = append(buff, token)
+				if token&0x20 != 0 {
+					key := byte(0xFF)
+					if note.Key > 96 {
+						key = 0xFE
+					} else if note.Key > 0 {
+						key = byte((note.Key-1)/12<<4 | (note.Key-1)%12)
+					}
+					buff = append(buff, key, byte(note.Instrument))
+				}
+				if token&0x40 != 0 {
+					buff = append(buff, byte(note.Volume-0x10))
+				}
+				if token&0x80 != 0 {
+					buff = append(buff, byte(note.Effect-0x80), byte(note.Param))
+				}
+			}
+			if needBreak {
+				report.add("patterns shorter than 64 rows")
+			}
+			buff = append(buff, 0)
+		}
+		length := len(buff) - start
+		buff[start] = byte(length)
+		buff[start+1] = byte(length >> 8)
+	}
+
+	for insIdx := 1; insIdx <= m.numInstruments; insIdx++ {
+		header := sampleHeaders[insIdx]
+		if buff[header] != 1 {
+			continue
+		}
+		for len(buff)&0xF != 0 {
+			buff = append(buff, 0)
+		}
+		pointer := len(buff) >> 4
+		buff[header+13] = byte(pointer >> 16)
+		buff[header+14] = byte(pointer)
+		buff[header+15] = byte(pointer >> 8)
+		data := samples[insIdx].Data()
+		if buff[header+31]&0x4 != 0 {
+			for _, ampl := range data {
+				buff = appendLE16(buff, int(uint16(ampl)^0x8000))
+			}
+		} else {
+			for _, ampl := range data {
+				buff = append(buff, byte(ampl>>8)^0x80)
+			}
+		}
+	}
+	_, e := w.Write(buff)
+	return e
+}
+
+var encoders = map[string]func(w io.Writer, m *Module, report *lossReport) error{
+	"xm":  encodeXM,
+	"mod": encodeMOD,
+	"s3m": encodeS3M,
+}
+
+/* Writes m in the named format ("xm", "mod" or "s3m") and returns descriptions of the features that could not be represented. */
+func Encode(w io.Writer, m *Module, format string) ([]string, error) {
+	encode, ok := encoders[format]
+	if !ok {
+		return nil, UnsupportedFormat
+	}
+	report := &lossReport{}
+	e := encode(w, m, report)
+	return report.lost, e
+}
@@ -0,0 +1,615 @@
+package ibxmgo
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+/* The note after each test note, to check that the test note does not change how the rest of the pattern is read. */
+var followingNote = Note{Key: 49, Instrument: 1}
+
+type noteTest struct {
+	name     string
+	note     Note
+	wantNote Note
+}
+
+/* Stores a note without the checks of Pattern.SetNote, so that keys only decoders produce can be used. */
+func setNote(pattern *Pattern, row, channel int, note Note) {
+	noteIdx := (row*pattern.NumChannels() + channel) * 5
+	pattern.data[noteIdx] = byte(note.Key)
+	pattern.data[noteIdx+1] = byte(note.Instrument)
+	pattern.data[noteIdx+2] = byte(note.Volume)
+	pattern.data[noteIdx+3] = byte(note.Effect)
+	pattern.data[noteIdx+4] = byte(note.Param)
+}
+
+/* Returns a module with the note of each test on channel 0 of a row, followed by followingNote on channel 1. */
+func noteTestModule(tests []noteTest, numRows int) *Module {
+	m := NewModule()
+	m.numChannels = 2
+	m.defaultPanning = []int{128, 128}
+	pattern := NewPattern(2, numRows)
+	for row, test := range tests {
+		setNote(pattern, row, 0, test.note)
+		setNote(pattern, row, 1, followingNote)
+	}
+	m.patterns[0] = pattern
+	return m
+}
+
+func checkNotes(t *testing.T, format string, m *Module, tests []noteTest) {
+	if len(m.patterns) < 1 || m.numChannels != 2 {
+		t.Fatalf("%s: %d channels, %d patterns", format, m.numChannels, len(m.patterns))
+	}
+	pattern := m.patterns[0]
+	for row, test := range tests {
+		if note := pattern.Note(row, 0); note != test.wantNote {
+			t.Errorf("%s %s: got %+v, want %+v", format, test.name, note, test.wantNote)
+		}
+		if note := pattern.Note(row, 1); note != followingNote {
+			t.Errorf("%s %s: following note is %+v", format, test.name, note)
+		}
+	}
+}
+
+/* Returns a sample with a waveform that uses all 16 bits unless eightBit is true. */
+func testSample(length, loopStart, loopLength int, pingPong, eightBit bool) *Sample {
+	data := make([]int16, length)
+	for idx := range data {
+		data[idx] = int16(idx*2417 - 30000)
+		if eightBit {
+			data[idx] &^= 0xFF
+		}
+	}
+	sample := NewSample()
+	sample.SetData(data, loopStart, loopLength, pingPong)
+	return sample
+}
+
+func checkSample(t *testing.T, name string, got, want *Sample) {
+	if !reflect.DeepEqual(got.Data(), want.Data()) {
+		t.Errorf("%s: sample data differs", name)
+	}
+	gotStart, gotLength := got.Loop()
+	wantStart, wantLength := want.Loop()
+	if gotStart != wantStart || gotLength != wantLength || got.PingPong() != want.PingPong() {
+		t.Errorf("%s: loop %d+%d ping-pong %v, want %d+%d ping-pong %v", name,
+			gotStart, gotLength, got.PingPong(), wantStart, wantLength, want.PingPong())
+	}
+	if got.volume != want.volume {
+		t.Errorf("%s: volume %d, want %d", name, got.volume, want.volume)
+	}
+}
+
+func encodeDecode(t *testing.T, m *Module, format string, decode func(*bufio.Reader) (*Module, error)) *Module {
+	var buff bytes.Buffer
+	if _, e := Encode(&buff, m, format); e != nil {
+		t.Fatalf("%s: %v", format, e)
+	}
+	decoded, e := decode(bufio.NewReader(&buff))
+	if e != nil {
+		t.Fatalf("%s: %v", format, e)
+	}
+	return decoded
+}
+
+func TestEncodeXMNotes(t *testing.T) {
+	tests := []noteTest{
+		{"empty", Note{}, Note{}},
+		{"key", Note{Key: 1}, Note{Key: 1}},
+		{"full note", Note{96, 2, 0x50, 0x0A, 0x0F}, Note{96, 2, 0x50, 0x0A, 0x0F}},
+		{"key off", Note{97, 0, 0, 0, 0}, Note{97, 0, 0, 0, 0}},
+		{"full key off", Note{97, 1, 0x30, 0x0A, 1}, Note{97, 1, 0x30, 0x0A, 1}},
+		{"note cut", Note{254, 1, 0x30, 0x84, 1}, Note{97, 1, 0x30, 0x0A, 1}},
+		{"note cut alone", Note{Key: 254}, Note{Key: 97}},
+		{"volume column", Note{0, 0, 0xC8, 0, 0}, Note{0, 0, 0xC8, 0, 0}},
+		{"extended effect", Note{0, 0, 0, 0x0E, 0x93}, Note{0, 0, 0, 0x0E, 0x93}},
+		{"S3M speed", Note{0, 0, 0, 0x81, 3}, Note{0, 0, 0, 0x0F, 3}},
+		{"S3M global volume", Note{0, 0, 0, 0x96, 0x20}, Note{0, 0, 0, 0x10, 0x20}},
+		{"S3M volume slide", Note{0, 0, 0, 0x84, 0x30}, Note{0, 0, 0, 0x0A, 0x30}},
+		{"S3M fine volume slide up", Note{0, 0, 0, 0x84, 0x3F}, Note{0, 0, 0, 0x0E, 0xA3}},
+		{"S3M fine volume slide down", Note{0, 0, 0, 0x84, 0xF2}, Note{0, 0, 0, 0x0E, 0xB2}},
+		{"S3M fine porta down", Note{0, 0, 0, 0x85, 0xF3}, Note{0, 0, 0, 0x0E, 0x23}},
+		{"S3M extra fine porta down", Note{0, 0, 0, 0x85, 0xE4}, Note{0, 0, 0, 0x21, 0x24}},
+		{"S3M fine porta up", Note{0, 0, 0, 0x86, 0xF5}, Note{0, 0, 0, 0x0E, 0x15}},
+		{"S3M extra fine porta up", Note{0, 0, 0, 0x86, 0xE6}, Note{0, 0, 0, 0x21, 0x16}},
+		{"S3M porta up", Note{0, 0, 0, 0x86, 0xD0}, Note{0, 0, 0, 0x01, 0xD0}},
+	}
+	m := noteTestModule(tests, 32)
+	checkNotes(t, "xm", encodeDecode(t, m, "xm", DecodeXM), tests)
+
+	m = noteTestModule([]noteTest{{"fine volume slide with vibrato", Note{0, 0, 0, 0x8B, 0x1F}, Note{}}}, 16)
+	lost, e := Encode(ioutil.Discard, m, "xm")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !reflect.DeepEqual(lost, []string{"fine volume slides with vibrato or tone portamento"}) {
+		t.Errorf("lost %q", lost)
+	}
+}
+
+func TestEncodeXMRoundTrip(t *testing.T) {
+	m := NewModule()
+	m.songName = "Round trip"
+	m.c2Rate = NTSC
+	m.linearPeriods = true
+	m.defaultSpeed, m.defaultTempo = 5, 140
+	m.defaultPanning = []int{128, 128, 128, 128}
+	m.patterns = []*Pattern{NewPattern(4, 32), NewPattern(4, 8)}
+	m.numPatterns = 2
+	m.sequence = []int{0, 1, 0}
+	m.sequenceLength = 3
+	m.restartPos = 1
+	samples := []*Sample{
+		testSample(1000, 0, 0, false, true),
+		testSample(1000, 200, 600, false, false),
+		testSample(1000, 300, 400, true, false),
+	}
+	m.instruments = []*Instrument{DefaultInstrument()}
+	for idx, sample := range samples {
+		instrument := DefaultInstrument()
+		instrument.name = "Instrument"
+		sample.volume = 10 + idx*20
+		instrument.samples[0] = sample
+		m.instruments = append(m.instruments, instrument)
+	}
+	m.numInstruments = len(samples)
+	multi := xmTestInstrument(t)
+	if _, e := m.AddInstrument(multi); e != nil {
+		t.Fatal(e)
+	}
+	for row := 0; row < 32; row++ {
+		for chanIdx := 0; chanIdx < 4; chanIdx++ {
+			note := Note{Key: 37 + (row*5+chanIdx*7)%48, Instrument: 1 + (row+chanIdx)%3}
+			if row%3 == 0 {
+				note.Volume = 0x10 + row*2
+				note.Effect, note.Param = 0x0A, 0x02
+			}
+			if row%5 == chanIdx {
+				note = Note{Key: 97}
+			}
+			m.patterns[0].SetNote(row, chanIdx, note)
+			if row < 8 {
+				note := Note{Key: 49, Instrument: 1 + chanIdx%3, Effect: 0x04, Param: 0x44}
+				if chanIdx == 3 {
+					/* Keys in both samples of the multi-sample instrument, with key off to release the envelopes. */
+					note = Note{Key: 25 + row*8, Instrument: 4}
+					if row%4 == 3 {
+						note = Note{Key: 97}
+					}
+				}
+				m.patterns[1].SetNote(row, chanIdx, note)
+			}
+		}
+	}
+
+	decoded := encodeDecode(t, m, "xm", DecodeXM)
+	if !reflect.DeepEqual(decoded.Sequence(), m.Sequence()) || decoded.restartPos != m.restartPos {
+		t.Errorf("sequence %v restart %d, want %v restart %d",
+			decoded.Sequence(), decoded.restartPos, m.Sequence(), m.restartPos)
+	}
+	if decoded.defaultSpeed != 5 || decoded.defaultTempo != 140 || !decoded.linearPeriods {
+		t.Errorf("speed %d tempo %d linear %v", decoded.defaultSpeed, decoded.defaultTempo, decoded.linearPeriods)
+	}
+	for patIdx, pattern := range m.patterns {
+		if !bytes.Equal(decoded.patterns[patIdx].data, pattern.data) {
+			t.Errorf("pattern %d differs", patIdx)
+		}
+	}
+	for idx, sample := range samples {
+		checkSample(t, "instrument "+decoded.instruments[idx+1].Name(), decoded.instruments[idx+1].samples[0], sample)
+	}
+	checkInstrument(t, decoded.instruments[4], multi)
+
+	var want, got bytes.Buffer
+	original, _ := NewIBXM(m, 48000)
+	original.Dump(&want)
+	roundTrip, _ := NewIBXM(decoded, 48000)
+	roundTrip.Dump(&got)
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Errorf("playback differs")
+	}
+}
+
+/* Returns an instrument with two samples split at key 49, envelopes with sustain and loop, auto-vibrato and fade out. */
+func xmTestInstrument(t *testing.T) *Instrument {
+	instrument := DefaultInstrument()
+	instrument.SetName("Multi")
+	low, high := testSample(800, 100, 500, false, false), testSample(600, 0, 0, false, true)
+	low.volume, high.volume = 48, 64
+	high.relNote, high.fineTune = -12, 16
+	check := func(e error) {
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+	check(instrument.SetSamples([]*Sample{low, high}))
+	for key := 49; key <= 96; key++ {
+		check(instrument.SetKeyToSample(key, 1))
+	}
+	volume, panning := &Envelope{}, &Envelope{}
+	check(volume.SetPoints([]EnvelopePoint{{0, 0}, {4, 64}, {10, 40}, {20, 48}, {40, 0}}))
+	check(volume.SetSustain(true, 10))
+	check(volume.SetLoop(true, 10, 20))
+	check(volume.SetEnabled(true))
+	check(panning.SetPoints([]EnvelopePoint{{0, 32}, {8, 0}, {16, 64}}))
+	check(panning.SetLoop(true, 0, 16))
+	check(panning.SetEnabled(true))
+	check(instrument.SetVolumeEnvelope(volume))
+	check(instrument.SetPanningEnvelope(panning))
+	check(instrument.SetVibrato(1, 10, 8, 20))
+	check(instrument.SetVolumeFadeOut(512))
+	return instrument
+}
+
+/* Checks the envelopes, vibrato, fade out, key map and samples of got against want. */
+func checkInstrument(t *testing.T, got, want *Instrument) {
+	name := "instrument " + want.Name()
+	if got.Name() != want.Name() {
+		t.Errorf("%s: name %q", name, got.Name())
+	}
+	envelopes := []struct {
+		name      string
+		got, want *Envelope
+	}{
+		{"volume", got.VolumeEnvelope(), want.VolumeEnvelope()},
+		{"panning", got.PanningEnvelope(), want.PanningEnvelope()},
+	}
+	for _, env := range envelopes {
+		if !reflect.DeepEqual(env.got.Points(), env.want.Points()) || env.got.Enabled() != env.want.Enabled() {
+			t.Errorf("%s: %s envelope %v enabled %v, want %v enabled %v", name, env.name,
+				env.got.Points(), env.got.Enabled(), env.want.Points(), env.want.Enabled())
+		}
+		gotSustain, gotSustainTick := env.got.Sustain()
+		wantSustain, wantSustainTick := env.want.Sustain()
+		if gotSustain != wantSustain || (wantSustain && gotSustainTick != wantSustainTick) {
+			t.Errorf("%s: %s sustain %v at %d, want %v at %d", name, env.name,
+				gotSustain, gotSustainTick, wantSustain, wantSustainTick)
+		}
+		gotLoop, gotStart, gotEnd := env.got.Loop()
+		wantLoop, wantStart, wantEnd := env.want.Loop()
+		if gotLoop != wantLoop || (wantLoop && (gotStart != wantStart || gotEnd != wantEnd)) {
+			t.Errorf("%s: %s loop %v %d-%d, want %v %d-%d", name, env.name,
+				gotLoop, gotStart, gotEnd, wantLoop, wantStart, wantEnd)
+		}
+	}
+	gotType, gotSweep, gotDepth, gotRate := got.Vibrato()
+	wantType, wantSweep, wantDepth, wantRate := want.Vibrato()
+	if gotType != wantType || gotSweep != wantSweep || gotDepth != wantDepth || gotRate != wantRate {
+		t.Errorf("%s: vibrato %d %d %d %d, want %d %d %d %d", name,
+			gotType, gotSweep, gotDepth, gotRate, wantType, wantSweep, wantDepth, wantRate)
+	}
+	if got.VolumeFadeOut() != want.VolumeFadeOut() {
+		t.Errorf("%s: fade out %d, want %d", name, got.VolumeFadeOut(), want.VolumeFadeOut())
+	}
+	for key := 1; key <= 96; key++ {
+		if got.KeyToSample(key) != want.KeyToSample(key) {
+			t.Errorf("%s: key %d plays sample %d, want %d", name, key, got.KeyToSample(key), want.KeyToSample(key))
+		}
+	}
+	gotSamples, wantSamples := got.Samples(), want.Samples()
+	if len(gotSamples) != len(wantSamples) {
+		t.Fatalf("%s: %d samples, want %d", name, len(gotSamples), len(wantSamples))
+	}
+	for idx, sample := range wantSamples {
+		checkSample(t, name, gotSamples[idx], sample)
+		if gotSamples[idx].RelNote() != sample.RelNote() || gotSamples[idx].FineTune() != sample.FineTune() {
+			t.Errorf("%s: sample %d relative note %d fine tune %d, want %d %d", name, idx,
+				gotSamples[idx].RelNote(), gotSamples[idx].FineTune(), sample.RelNote(), sample.FineTune())
+		}
+	}
+}
+
+func TestEncodeXMEnvelopeWithoutPoints(t *testing.T) {
+	m := NewModule()
+	m.instruments[1].volumeEnvelope = &Envelope{}
+	decoded := encodeDecode(t, m, "xm", DecodeXM)
+	if env := decoded.instruments[1].volumeEnvelope; env.enabled || env.numPoints != 0 {
+		t.Errorf("envelope enabled %v with %d points, want disabled with none", env.enabled, env.numPoints)
+	}
+}
+
+/* Adds silent instruments until the module has numInstruments. */
+func addInstruments(m *Module, numInstruments int) {
+	for m.numInstruments < numInstruments {
+		m.instruments = append(m.instruments[:m.numInstruments+1], DefaultInstrument())
+		m.numInstruments++
+	}
+}
+
+func TestEncodeMODNotes(t *testing.T) {
+	tests := []noteTest{
+		{"empty", Note{}, Note{}},
+		{"lowest key", Note{Key: 37, Instrument: 1}, Note{Key: 37, Instrument: 1}},
+		{"high instrument", Note{Key: 72, Instrument: 17}, Note{Key: 72, Instrument: 17}},
+		{"full note", Note{49, 2, 0, 0x0A, 0x02}, Note{49, 2, 0, 0x0A, 0x02}},
+		{"volume column", Note{49, 1, 0x30, 0, 0}, Note{49, 1, 0, 0x0C, 0x20}},
+		{"volume column and effect", Note{49, 1, 0x30, 0x0A, 0x02}, Note{49, 1, 0, 0x0A, 0x02}},
+		{"key off", Note{Key: 97}, Note{}},
+		{"note cut", Note{Key: 254, Instrument: 1}, Note{Instrument: 1}},
+		{"key out of range", Note{Key: 1, Instrument: 1}, Note{Instrument: 1}},
+		{"S3M tempo", Note{0, 0, 0, 0x94, 0x80}, Note{0, 0, 0, 0x0F, 0x80}},
+		{"slide without parameter", Note{0, 0, 0, 0x01, 0}, Note{}},
+		{"panning", Note{0, 0, 0, 0x08, 0x80}, Note{0, 0, 0, 0x08, 0x80}},
+		{"S3M fine volume slide", Note{0, 0, 0, 0x84, 0x3F}, Note{0, 0, 0, 0x0E, 0xA3}},
+		{"S3M fine porta", Note{0, 0, 0, 0x86, 0xF5}, Note{0, 0, 0, 0x0E, 0x15}},
+		{"S3M extra fine porta", Note{0, 0, 0, 0x86, 0xE6}, Note{}},
+	}
+	m := noteTestModule(tests, 64)
+	addInstruments(m, 17)
+	checkNotes(t, "mod", encodeDecode(t, m, "mod", DecodeMOD), tests)
+}
+
+func TestEncodeMODRoundTrip(t *testing.T) {
+	m := NewModule()
+	m.songName = "Round trip"
+	m.patterns = []*Pattern{NewPattern(4, 64), NewPattern(4, 64)}
+	m.numPatterns = 2
+	m.sequence = []int{0, 1, 0}
+	m.sequenceLength = 3
+	m.restartPos = 1
+	samples := []*Sample{
+		testSample(1000, 0, 0, false, true),
+		testSample(1000, 200, 600, false, true),
+	}
+	m.instruments = []*Instrument{DefaultInstrument()}
+	for idx, sample := range samples {
+		instrument := DefaultInstrument()
+		instrument.name = "Instrument"
+		sample.volume = 10 + idx*20
+		sample.c2Rate = PAL
+		instrument.samples[0] = sample
+		m.instruments = append(m.instruments, instrument)
+	}
+	m.numInstruments = len(samples)
+	for row := 0; row < 64; row++ {
+		for chanIdx := 0; chanIdx < 4; chanIdx++ {
+			note := Note{Key: 37 + (row*5+chanIdx*7)%36, Instrument: 1 + (row+chanIdx)%2}
+			if row%3 == 0 {
+				note.Effect, note.Param = 0x0A, 0x02
+			}
+			m.patterns[0].SetNote(row, chanIdx, note)
+			m.patterns[1].SetNote(row, chanIdx, Note{Key: 49, Instrument: 1 + chanIdx%2, Effect: 0x04, Param: 0x44})
+		}
+	}
+
+	decoded := encodeDecode(t, m, "mod", DecodeMOD)
+	if !reflect.DeepEqual(decoded.Sequence(), m.Sequence()) || decoded.restartPos != m.restartPos {
+		t.Errorf("sequence %v restart %d, want %v restart %d",
+			decoded.Sequence(), decoded.restartPos, m.Sequence(), m.restartPos)
+	}
+	for patIdx, pattern := range m.patterns {
+		if !bytes.Equal(decoded.patterns[patIdx].data, pattern.data) {
+			t.Errorf("pattern %d differs", patIdx)
+		}
+	}
+	for idx, sample := range samples {
+		checkSample(t, "instrument "+decoded.instruments[idx+1].Name(), decoded.instruments[idx+1].samples[0], sample)
+	}
+
+	var want, got bytes.Buffer
+	original, _ := NewIBXM(m, 48000)
+	original.Dump(&want)
+	roundTrip, _ := NewIBXM(decoded, 48000)
+	roundTrip.Dump(&got)
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Errorf("playback differs")
+	}
+}
+
+func TestEncodeMODInitialSpeed(t *testing.T) {
+	tests := []struct {
+		sequence, wantSequence []int
+	}{
+		{[]int{0, 1}, []int{0, 1}},
+		{[]int{0, 1, 0}, []int{2, 1, 0}},
+		{[]int{1, 0, 1, 1}, []int{2, 0, 1, 1}},
+	}
+	for _, test := range tests {
+		m := NewModule()
+		m.defaultSpeed, m.defaultTempo = 4, 150
+		m.patterns = []*Pattern{NewPattern(4, 64), NewPattern(4, 64)}
+		m.numPatterns = 2
+		m.sequence = test.sequence
+		m.sequenceLength = len(test.sequence)
+		for patIdx, pattern := range m.patterns {
+			pattern.SetNote(0, 0, Note{Key: 49 + patIdx, Instrument: 1})
+			pattern.SetNote(0, 2, Note{Effect: 0x0A, Param: 0x01})
+		}
+		decoded := encodeDecode(t, m, "mod", DecodeMOD)
+		if sequence := decoded.Sequence(); !reflect.DeepEqual(sequence, test.wantSequence) {
+			t.Errorf("sequence %v: encoded as %v, want %v", test.sequence, sequence, test.wantSequence)
+			continue
+		}
+		for patIdx, pattern := range decoded.patterns[:decoded.numPatterns] {
+			wantSpeed := patIdx == test.wantSequence[0]
+			speed, tempo := pattern.Note(0, 0), pattern.Note(0, 1)
+			if (speed.Effect == 0x0F && speed.Param == 4 && tempo == Note{Effect: 0x0F, Param: 150}) != wantSpeed {
+				t.Errorf("sequence %v: pattern %d row 0 has %+v and %+v", test.sequence, patIdx, speed, tempo)
+			}
+		}
+
+		var want, got bytes.Buffer
+		original, _ := NewIBXM(m, 48000)
+		original.Dump(&want)
+		roundTrip, _ := NewIBXM(decoded, 48000)
+		roundTrip.Dump(&got)
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Errorf("sequence %v: playback differs", test.sequence)
+		}
+	}
+}
+
+func TestEncodeMODErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(m *Module)
+	}{
+		{"rows", func(m *Module) { m.patterns[0] = NewPattern(4, 32) }},
+		{"instruments", func(m *Module) { addInstruments(m, 32) }},
+		{"envelope", func(m *Module) { m.instruments[1].volumeEnvelope.enabled = true }},
+	}
+	for _, test := range tests {
+		m := NewModule()
+		test.modify(m)
+		var buff bytes.Buffer
+		if e := EncodeMOD(&buff, m); e == nil {
+			t.Errorf("%s: no error", test.name)
+		} else if _, ok := e.(*EncodeError); !ok {
+			t.Errorf("%s: %v is not an EncodeError", test.name, e)
+		}
+	}
+}
+
+func TestEncodeS3MNotes(t *testing.T) {
+	tests := []noteTest{
+		{"empty", Note{}, Note{}},
+		{"lowest key", Note{Key: 1, Instrument: 1}, Note{Key: 1, Instrument: 1}},
+		{"highest key", Note{Key: 96, Instrument: 99}, Note{Key: 96, Instrument: 99}},
+		{"note cut", Note{Key: 254, Instrument: 1}, Note{Key: 254, Instrument: 1}},
+		{"key off", Note{Key: 97}, Note{Key: 254}},
+		{"full note", Note{49, 2, 0x50, 0x84, 0x0F}, Note{49, 2, 0x50, 0x84, 0x0F}},
+		{"volume column slide", Note{0, 0, 0x65, 0, 0}, Note{0, 0, 0, 0x84, 0x05}},
+		{"XM volume slide", Note{0, 0, 0, 0x0A, 0x20}, Note{0, 0, 0, 0x84, 0x20}},
+		{"XM speed", Note{0, 0, 0, 0x0F, 3}, Note{0, 0, 0, 0x81, 3}},
+		{"XM tempo", Note{0, 0, 0, 0x0F, 0x80}, Note{0, 0, 0, 0x94, 0x80}},
+		{"XM panning", Note{0, 0, 0, 0x08, 0x88}, Note{0, 0, 0, 0x93, 0x88}},
+		{"XM set volume", Note{0, 0, 0, 0x0C, 0x20}, Note{0, 0, 0x30, 0, 0}},
+	}
+	m := noteTestModule(tests, 16)
+	addInstruments(m, 99)
+	checkNotes(t, "s3m", encodeDecode(t, m, "s3m", DecodeS3M), tests)
+}
+
+func TestEncodeS3MRoundTrip(t *testing.T) {
+	m := NewModule()
+	m.songName = "Round trip"
+	m.c2Rate = NTSC
+	m.defaultSpeed, m.defaultTempo = 4, 150
+	m.defaultPanning = []int{3 * 17, 12 * 17, 12 * 17, 3 * 17}
+	m.patterns = []*Pattern{NewPattern(4, 64), NewPattern(4, 64)}
+	m.numPatterns = 2
+	m.sequence = []int{0, 1, 0, 1}
+	m.sequenceLength = 4
+	samples := []*Sample{
+		testSample(1000, 0, 0, false, true),
+		testSample(1000, 200, 600, false, false),
+	}
+	m.instruments = []*Instrument{DefaultInstrument()}
+	for idx, sample := range samples {
+		instrument := DefaultInstrument()
+		instrument.name = "Instrument"
+		sample.volume = 10 + idx*20
+		sample.c2Rate = C2Rate(8000 + idx*1000)
+		instrument.samples[0] = sample
+		m.instruments = append(m.instruments, instrument)
+	}
+	m.numInstruments = len(samples)
+	for row := 0; row < 64; row++ {
+		for chanIdx := 0; chanIdx < 4; chanIdx++ {
+			note := Note{Key: 1 + (row*5+chanIdx*7)%96, Instrument: 1 + (row+chanIdx)%2}
+			if row%3 == 0 {
+				note.Volume = 0x10 + row
+				note.Effect, note.Param = 0x84, 0x02
+			}
+			if row%5 == chanIdx {
+				note = Note{Key: 254}
+			}
+			m.patterns[0].SetNote(row, chanIdx, note)
+			m.patterns[1].SetNote(row, chanIdx, Note{Key: 49, Instrument: 1 + chanIdx%2, Effect: 0x88, Param: 0x44})
+		}
+	}
+
+	decoded := encodeDecode(t, m, "s3m", DecodeS3M)
+	if !reflect.DeepEqual(decoded.Sequence(), m.Sequence()) {
+		t.Errorf("sequence %v, want %v", decoded.Sequence(), m.Sequence())
+	}
+	if !reflect.DeepEqual(decoded.defaultPanning, m.defaultPanning) {
+		t.Errorf("panning %v, want %v", decoded.defaultPanning, m.defaultPanning)
+	}
+	if decoded.defaultSpeed != 4 || decoded.defaultTempo != 150 {
+		t.Errorf("speed %d tempo %d", decoded.defaultSpeed, decoded.defaultTempo)
+	}
+	for patIdx, pattern := range m.patterns {
+		if !bytes.Equal(decoded.patterns[patIdx].data, pattern.data) {
+			t.Errorf("pattern %d differs", patIdx)
+		}
+	}
+	for idx, sample := range samples {
+		got := decoded.instruments[idx+1].samples[0]
+		checkSample(t, "instrument "+decoded.instruments[idx+1].Name(), got, sample)
+		if got.c2Rate != sample.c2Rate {
+			t.Errorf("instrument %d: C2 rate %d, want %d", idx+1, got.c2Rate, sample.c2Rate)
+		}
+	}
+
+	var want, got bytes.Buffer
+	original, _ := NewIBXM(m, 48000)
+	original.Dump(&want)
+	roundTrip, _ := NewIBXM(decoded, 48000)
+	roundTrip.Dump(&got)
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Errorf("playback differs")
+	}
+}
+
+func TestEncodeS3MChannelSettings(t *testing.T) {
+	m := NewModule()
+	m.SetNumChannels(16)
+	/* More channels on the left than there are left PCM channels. */
+	for chanIdx := range m.defaultPanning {
+		m.defaultPanning[chanIdx] = 3 * 17
+		if chanIdx%4 == 3 {
+			m.defaultPanning[chanIdx] = 12 * 17
+		}
+	}
+	var buff bytes.Buffer
+	if e := EncodeS3M(&buff, m); e != nil {
+		t.Fatal(e)
+	}
+	settings := buff.Bytes()[64:96]
+	used := make(map[byte]bool)
+	for chanIdx, setting := range settings[:16] {
+		if setting > 15 || used[setting] {
+			t.Errorf("channel %d: setting %d is invalid or used twice", chanIdx, setting)
+		}
+		used[setting] = true
+	}
+	for chanIdx, setting := range settings[16:] {
+		if setting != 0xFF {
+			t.Errorf("channel %d: setting %d, want unused", chanIdx+16, setting)
+		}
+	}
+	decoded, e := DecodeS3M(bufio.NewReader(&buff))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !reflect.DeepEqual(decoded.DefaultPanning(), m.DefaultPanning()) {
+		t.Errorf("panning %v, want %v", decoded.DefaultPanning(), m.DefaultPanning())
+	}
+}
+
+func TestEncodeS3MErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(m *Module)
+	}{
+		{"rows", func(m *Module) { m.patterns[0] = NewPattern(4, 65) }},
+		{"channels", func(m *Module) { m.SetNumChannels(17) }},
+		{"sequence", func(m *Module) { m.sequence = make([]int, 257); m.sequenceLength = 257 }},
+	}
+	for _, test := range tests {
+		m := NewModule()
+		test.modify(m)
+		var buff bytes.Buffer
+		if e := EncodeS3M(&buff, m); e == nil {
+			t.Errorf("%s: no error", test.name)
+		} else if _, ok := e.(*EncodeError); !ok {
+			t.Errorf("%s: %v is not an EncodeError", test.name, e)
+		}
+	}
+}
@@ -16,6 +16,86 @@ func DefaultEnvelope() *Envelope {
 	}
 }
 
+/* A point of an envelope. Ampl is in the range 0 to 64. */
+type EnvelopePoint struct {
+	Tick, Ampl int
+}
+
+func (this *Envelope) Enabled() bool {
+	return this.enabled
+}
+
+func (this *Envelope) Points() []EnvelopePoint {
+	points := make([]EnvelopePoint, this.numPoints)
+	for idx := range points {
+		points[idx] = EnvelopePoint{this.pointsTick[idx], this.pointsAmpl[idx]}
+	}
+	return points
+}
+
+/* Returns whether the envelope holds at a tick while the key is down. */
+func (this *Envelope) Sustain() (enabled bool, tick int) {
+	return this.sustain, this.sustainTick
+}
+
+/* Returns whether the envelope loops, and the loop start and end ticks. */
+func (this *Envelope) Loop() (enabled bool, startTick, endTick int) {
+	return this.looped, this.loopStartTick, this.loopEndTick
+}
+
+/* Enables or disables the envelope. An envelope without points cannot be enabled. */
+func (this *Envelope) SetEnabled(enabled bool) error {
+	if enabled && (this.numPoints < 1 || this.numPoints > len(this.pointsTick) || this.numPoints > len(this.pointsAmpl)) {
+		return ValueOutOfRange
+	}
+	this.enabled = enabled
+	return nil
+}
+
+/* Replaces the points. Ticks must start at 0 and increase, and amplitudes must be in the range 0 to 64. */
+func (this *Envelope) SetPoints(points []EnvelopePoint) error {
+	if len(points) < 1 || points[0].Tick != 0 {
+		return ValueOutOfRange
+	}
+	for idx, point := range points {
+		if point.Ampl < 0 || point.Ampl > 64 {
+			return ValueOutOfRange
+		}
+		if idx > 0 && point.Tick <= points[idx-1].Tick {
+			return ValueOutOfRange
+		}
+	}
+	this.numPoints = len(points)
+	this.pointsTick = make([]int, this.numPoints)
+	this.pointsAmpl = make([]int, this.numPoints)
+	for idx, point := range points {
+		this.pointsTick[idx] = point.Tick
+		this.pointsAmpl[idx] = point.Ampl
+	}
+	return nil
+}
+
+/* Sets whether the envelope holds at tick while the key is down. */
+func (this *Envelope) SetSustain(enabled bool, tick int) error {
+	if tick < 0 {
+		return ValueOutOfRange
+	}
+	this.sustain = enabled
+	this.sustainTick = tick
+	return nil
+}
+
+/* Sets whether the envelope loops from endTick back to startTick. */
+func (this *Envelope) SetLoop(enabled bool, startTick, endTick int) error {
+	if startTick < 0 || endTick < startTick {
+		return ValueOutOfRange
+	}
+	this.looped = enabled
+	this.loopStartTick = startTick
+	this.loopEndTick = endTick
+	return nil
+}
+
 func (this *Envelope) nextTick(tick int, keyOn bool) int {
 	tick++
 	if this.looped && tick >= this.loopEndTick {
@@ -43,3 +123,24 @@ func (this *Envelope) calculateAmpl(tick int) int {
 	}
 	return ampl
 }
+
+/* Returns the tick of the specified point, or zero if there is no such point. */
+func (this *Envelope) pointTick(point int) int {
+	if point < 0 || point >= len(this.pointsTick) {
+		return 0
+	}
+	return this.pointsTick[point]
+}
+
+/* Disable the envelope if its points cannot be interpolated. */
+func (this *Envelope) checkPoints() {
+	if this.numPoints > len(this.pointsTick) || this.numPoints > len(this.pointsAmpl) {
+		this.numPoints = 0
+		this.enabled = false
+	}
+	for point := 1; point < this.numPoints; point++ {
+		if this.pointsTick[point] <= this.pointsTick[point-1] {
+			this.enabled = false
+		}
+	}
+}
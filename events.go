@@ -0,0 +1,55 @@
+package ibxmgo
+
+type EventType int
+
+const (
+	EVENT_ORDER        = EventType(0) /* A new position in the sequence has been reached. */
+	EVENT_ROW          = EventType(1) /* A new row has started. */
+	EVENT_PATTERN_LOOP = EventType(2) /* A pattern loop jumps back to Row. */
+	EVENT_NOTE_ON      = EventType(3)
+	EVENT_NOTE_OFF     = EventType(4)
+)
+
+/* Event describes something that happens during playback. Fields that do not apply to the type are zero. */
+type Event struct {
+	Type   EventType
+	Offset int /* Sample offset of the event in the audio being generated, 0 for events at the start of a tick. */
+	SequencePos, Pattern, Row,
+	Channel, Key, Instrument, Volume int
+}
+
+/* Set a function to be called from GetAudio() for each event in the audio it generates, or nil. GetAudio() generates one tick per call and events happen at the start of a tick, so their offset is currently always 0. */
+func (this *IBXM) SetEventHandler(handler func(event Event)) {
+	this.eventHandler = handler
+}
+
+/* Report the events of the tick that starts at offset in the audio being generated. */
+func (this *IBXM) dispatchEvents(offset int) {
+	if this.eventHandler != nil {
+		for _, event := range this.events {
+			event.Offset = offset
+			if event.Type == EVENT_NOTE_ON || event.Type == EVENT_NOTE_OFF {
+				event.SequencePos = this.seqPos
+				event.Pattern = this.module.sequence[this.seqPos]
+				event.Row = this.row
+			}
+			this.eventHandler(event)
+		}
+	}
+	this.events = this.events[:0]
+}
+
+func (this *Channel) noteOff() {
+	if this.events != nil {
+		*this.events = append(*this.events, Event{Type: EVENT_NOTE_OFF, Channel: this.id, Key: this.noteKey})
+	}
+}
+
+/* Report a note triggered during this row or tick, once effects have set its volume. */
+func (this *Channel) flushNoteOn() {
+	if this.noteOnPending && this.events != nil {
+		*this.events = append(*this.events, Event{Type: EVENT_NOTE_ON, Channel: this.id,
+			Key: this.noteKey, Instrument: this.insIdx, Volume: this.volume})
+	}
+	this.noteOnPending = false
+}
@@ -1,25 +1,36 @@
 package ibxmgo
 
 import (
-	"encoding/binary"
 	"errors"
 	"io"
+	"time"
 )
 
 var (
 	UnsupportedSamplingRate = errors.New("Unsupported sampling rate")
+	EndlessSong             = errors.New("Song never ends with a loop count of zero or less")
 )
 
 type IBXM struct {
 	module        *Module
 	rampBuf       []int32
+	floatMixBuf   []int32
+	stemRampBufs  [][]int32
 	channels      []*Channel
+	muted, solo   []bool
+	events        []Event
+	eventHandler  func(event Event)
 	interpolation Interpolation
 	sampleRate,
 	seqPos, breakSeqPos, row, nextRow, tick,
 	speed, tempo, plCount, plChannel int
-	globalVol int
-	note      *Note
+	globalVol                     int
+	note                          *Note
+	loopCount, playCount          int
+	fadePos, fadeEnd              int
+	startPos, endPos              int
+	fadeOut                       time.Duration
+	fading                        bool
 }
 
 func NewIBXM(module *Module, samplingRate int) (*IBXM, error) {
@@ -31,9 +42,17 @@ func NewIBXM(module *Module, samplingRate int) (*IBXM, error) {
 	this.SetSampleRate(samplingRate)
 	this.interpolation = LINEAR
 	this.rampBuf = make([]int32, 128)
+	this.stemRampBufs = make([][]int32, module.numChannels)
+	for idx := range this.stemRampBufs {
+		this.stemRampBufs[idx] = make([]int32, 128)
+	}
 	this.channels = make([]*Channel, module.numChannels)
+	this.muted = make([]bool, module.numChannels)
+	this.solo = make([]bool, module.numChannels)
 	this.globalVol = 0
 	this.note = &Note{}
+	this.loopCount = 1
+	this.endPos = -1
 	this.SetSequencePos(0)
 	return this, nil
 }
@@ -76,6 +95,7 @@ func (this *IBXM) SetInterpolation(interpolation Interpolation) {
 func (this *IBXM) GetAudio(outputBuf []int32) (samples int, songEnd bool) {
 
 	tickLen := this.CalculateTickLen(this.tempo, this.sampleRate)
+	this.dispatchEvents(0)
 	// Clear output buffer.
 	//
 	end := (tickLen + 65) * 4
@@ -83,45 +103,192 @@ func (this *IBXM) GetAudio(outputBuf []int32) (samples int, songEnd bool) {
 		outputBuf[idx] = 0
 	}
 	// Resample.
+	soloed := this.anySolo()
 	for chanIdx := 0; chanIdx < this.module.numChannels; chanIdx++ {
 		chn := this.channels[chanIdx]
-		chn.resample(outputBuf, 0, (tickLen+65)*2, this.sampleRate*2, this.interpolation)
+		if !this.muted[chanIdx] && (this.solo[chanIdx] || !soloed) {
+			chn.resample(outputBuf, 0, (tickLen+65)*2, this.sampleRate*2, this.interpolation)
+		}
 		chn.updateSampleIdx(tickLen*2, this.sampleRate*2)
 	}
 	this.downsample(outputBuf, tickLen+64)
-	this.volumeRamp(outputBuf, tickLen)
-	songEnd = this.doTick()
+	if this.fading {
+		this.fade(outputBuf, tickLen+64)
+	}
+	this.volumeRamp(outputBuf, this.rampBuf, tickLen)
+	songEnd = this.updateSongEnd(this.doTick(), tickLen)
+	return tickLen, songEnd
+}
+
+/* Generate audio as GetAudio, with amplitudes scaled so that full scale is 1.0. No clipping is performed. */
+func (this *IBXM) GetAudioFloat32(outputBuf []float32) (samples int, songEnd bool) {
+	if this.floatMixBuf == nil {
+		this.floatMixBuf = make([]int32, this.AudioBufferLength())
+	}
+	samples, songEnd = this.GetAudio(this.floatMixBuf)
+	for idx, x := range this.floatMixBuf[:samples*2] {
+		outputBuf[idx] = float32(x) / 32768
+	}
+	return samples, songEnd
+}
+
+/* Generate audio for each channel into its own buffer, each at least AudioBufferLength() long. */
+func (this *IBXM) GetStems(outputBufs [][]int32) (samples int, songEnd bool) {
+	tickLen := this.CalculateTickLen(this.tempo, this.sampleRate)
+	this.dispatchEvents(0)
+	end := (tickLen + 65) * 4
+	soloed := this.anySolo()
+	for chanIdx := 0; chanIdx < this.module.numChannels; chanIdx++ {
+		outputBuf := outputBufs[chanIdx]
+		for idx := 0; idx < end; idx++ {
+			outputBuf[idx] = 0
+		}
+		chn := this.channels[chanIdx]
+		if !this.muted[chanIdx] && (this.solo[chanIdx] || !soloed) {
+			chn.resample(outputBuf, 0, (tickLen+65)*2, this.sampleRate*2, this.interpolation)
+		}
+		chn.updateSampleIdx(tickLen*2, this.sampleRate*2)
+		this.downsample(outputBuf, tickLen+64)
+		if this.fading {
+			this.fade(outputBuf, tickLen+64)
+		}
+		this.volumeRamp(outputBuf, this.stemRampBufs[chanIdx], tickLen)
+	}
+	songEnd = this.updateSongEnd(this.doTick(), tickLen)
 	return tickLen, songEnd
 }
 
-/* Dump raw audio data */
+/* Set the number of times the song is played before the end is reported. Zero or less plays forever, so the Dump methods return EndlessSong. */
+func (this *IBXM) SetLoopCount(count int) {
+	this.loopCount = count
+}
+
+/* Play only the sequence positions from start to end inclusive, from start. Leaving the range ends the song and returns to start. A negative end plays to the end of the sequence. */
+func (this *IBXM) SetSequenceRange(start, end int) {
+	if start < 0 || start >= this.module.sequenceLength {
+		start = 0
+	}
+	if end >= 0 && end < start {
+		end = start
+	}
+	this.startPos = start
+	this.endPos = end
+	this.SetSequencePos(start)
+}
+
+/* Set the time to fade out over after the song has been played the number of times set by SetLoopCount. */
+func (this *IBXM) SetFadeOut(fadeOut time.Duration) {
+	this.fadeOut = fadeOut
+}
+
+/* Apply the loop count and fade out to the song end reported by doTick. */
+func (this *IBXM) updateSongEnd(songEnd bool, tickLen int) bool {
+	if this.fading {
+		this.fadePos += tickLen
+		if this.fadePos >= this.fadeEnd {
+			this.fading = false
+			this.fadePos = 0
+			return true
+		}
+		return false
+	}
+	if songEnd && this.loopCount > 0 {
+		this.playCount++
+		if this.playCount >= this.loopCount {
+			this.playCount = 0
+			/* The length is kept, as SetFadeOut may be called during the fade. */
+			if this.fadeEnd = this.fadeLen(); this.fadeEnd > 0 {
+				this.fading = true
+				return false
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func (this *IBXM) fadeLen() int {
+	return int(int64(this.fadeOut) * int64(this.sampleRate) / int64(time.Second))
+}
+
+/* Fade count samples from the start of the tick, including those kept for the volume ramp into the next tick. */
+func (this *IBXM) fade(mixBuf []int32, count int) {
+	fadeLen := int64(this.fadeEnd)
+	for idx := 0; idx < count; idx++ {
+		gain := fadeLen - int64(this.fadePos+idx)
+		if gain < 0 {
+			gain = 0
+		}
+		mixBuf[idx*2] = int32(int64(mixBuf[idx*2]) * gain / fadeLen)
+		mixBuf[idx*2+1] = int32(int64(mixBuf[idx*2+1]) * gain / fadeLen)
+	}
+}
+
+/* Returns the number of channels, and so the number of buffers required by GetStems(). */
+func (this *IBXM) NumChannels() int {
+	return this.module.numChannels
+}
+
+/* Mute or unmute a channel. Muted channels continue to be processed so that they can be unmuted at any time. */
+func (this *IBXM) SetChannelMute(chanIdx int, mute bool) {
+	if chanIdx >= 0 && chanIdx < len(this.muted) {
+		this.muted[chanIdx] = mute
+	}
+}
+
+func (this *IBXM) ChannelMuted(chanIdx int) bool {
+	return chanIdx >= 0 && chanIdx < len(this.muted) && this.muted[chanIdx]
+}
+
+/* While any channel is soloed, only soloed channels that are not muted are heard. */
+func (this *IBXM) SetChannelSolo(chanIdx int, solo bool) {
+	if chanIdx >= 0 && chanIdx < len(this.solo) {
+		this.solo[chanIdx] = solo
+	}
+}
+
+func (this *IBXM) ChannelSolo(chanIdx int) bool {
+	return chanIdx >= 0 && chanIdx < len(this.solo) && this.solo[chanIdx]
+}
+
+func (this *IBXM) anySolo() bool {
+	for _, solo := range this.solo {
+		if solo {
+			return true
+		}
+	}
+	return false
+}
+
+/* Dump raw audio data. Returns EndlessSong if the loop count is zero or less. */
 func (this *IBXM) Dump(w io.Writer) error {
+	_, e := this.dump(w, INT16)
+	return e
+}
+
+/* Write the whole song from the start as little-endian samples, returning the number of bytes written. */
+func (this *IBXM) dump(w io.Writer, format SampleFormat) (int, error) {
+	if this.loopCount <= 0 {
+		return 0, EndlessSong
+	}
 	data := make([]int32, this.AudioBufferLength())
-	buff := make([]byte, len(data)*2)
+	buff := make([]byte, len(data)*format.bytes())
 	t := this.SequencePos()
 	this.SetSequencePos(0)
 	defer this.SetSequencePos(t)
+	written := 0
 	for {
 		n, end := this.GetAudio(data)
-		n *= 2
-		for i := 0; i < n; i++ {
-			x := data[i]
-			if x > 32767 {
-				x = 32767
-			} else if x < -32768 {
-				x = -32768
-			}
-			binary.LittleEndian.PutUint16(buff[i*2:], uint16(x))
-		}
-		_, e := w.Write(buff[:n*2])
+		n = format.encode(buff, data[:n*2])
+		_, e := w.Write(buff[:n])
 		if e != nil {
-			return e
+			return written, e
 		}
+		written += n
 		if end {
-			return nil
+			return written, nil
 		}
 	}
-
 }
 
 /* Returns the length of the buffer required by getAudio(). */
@@ -133,14 +300,14 @@ func (this *IBXM) CalculateTickLen(tempo int, samplingRate int) int {
 	return (samplingRate * 5) / (tempo * 2)
 }
 
-func (this *IBXM) volumeRamp(mixBuf []int32, tickLen int) {
+func (this *IBXM) volumeRamp(mixBuf []int32, rampBuf []int32, tickLen int) {
 	rampRate := 256 * 2048 / this.sampleRate
 	for idx, a1 := 0, 0; a1 < 256; idx, a1 = idx+2, a1+rampRate {
 		a2 := 256 - a1
-		mixBuf[idx] = (mixBuf[idx]*int32(a1) + this.rampBuf[idx]*int32(a2)) >> 8
-		mixBuf[idx+1] = (mixBuf[idx+1]*int32(a1) + this.rampBuf[idx+1]*int32(a2)) >> 8
+		mixBuf[idx] = (mixBuf[idx]*int32(a1) + rampBuf[idx]*int32(a2)) >> 8
+		mixBuf[idx+1] = (mixBuf[idx+1]*int32(a1) + rampBuf[idx+1]*int32(a2)) >> 8
 	}
-	copy(this.rampBuf[:128], mixBuf[tickLen*2:])
+	copy(rampBuf[:128], mixBuf[tickLen*2:])
 }
 
 func (this *IBXM) downsample(buf []int32, count int) {
@@ -166,22 +333,68 @@ func (this *IBXM) SetSequencePos(pos int) {
 	if this.module.defaultSpeed > 0 {
 		this.speed = this.module.defaultSpeed
 	}
-	if this.module.defaultTempo > 0 {
+	if this.module.defaultTempo >= 32 {
 		this.tempo = this.module.defaultTempo
 	}
 	this.plCount = -1
 	this.plChannel = -1
+	this.playCount = 0
+	this.fading = false
+	this.fadePos = 0
 	for idx := 0; idx < this.module.numChannels; idx++ {
 		this.channels[idx] = NewChannel(this.module, idx, &this.globalVol)
+		this.channels[idx].events = &this.events
 	}
+	this.clearRampBufs()
+	this.doTick()
+}
+
+/* Clear the audio kept for ramping into the next tick, so that playback from a new position does not ramp from old audio. */
+func (this *IBXM) clearRampBufs() {
 	for idx := 0; idx < 128; idx++ {
 		this.rampBuf[idx] = 0
 	}
-	this.doTick()
+	for _, rampBuf := range this.stemRampBufs {
+		for idx := range rampBuf {
+			rampBuf[idx] = 0
+		}
+	}
+}
+
+/* Seek to the tick containing the specified sample position, counted from the start of the sequence range, returning the position reached. */
+func (this *IBXM) SeekSample(samplePos int) int {
+	this.SetSequencePos(this.startPos)
+	defer this.clearRampBufs()
+	currentPos := 0
+	for {
+		tickLen := this.CalculateTickLen(this.tempo, this.sampleRate)
+		if currentPos+tickLen > samplePos {
+			return currentPos
+		}
+		currentPos += tickLen
+		if this.skipTick(tickLen) {
+			return currentPos
+		}
+	}
+}
+
+/* Seek to the tick containing the specified time, returning the time reached. */
+func (this *IBXM) SeekTime(t time.Duration) time.Duration {
+	samplePos := this.SeekSample(int(int64(t) * int64(this.sampleRate) / int64(time.Second)))
+	return samplesToDuration(samplePos, this.sampleRate)
+}
+
+/* Advance by one tick without generating audio. Channel sample positions are still updated. */
+func (this *IBXM) skipTick(tickLen int) bool {
+	for chanIdx := 0; chanIdx < this.module.numChannels; chanIdx++ {
+		this.channels[chanIdx].updateSampleIdx(tickLen*2, this.sampleRate*2)
+	}
+	return this.doTick()
 }
 
 func (this *IBXM) doTick() bool {
 	songEnd := false
+	this.events = this.events[:0]
 	this.tick--
 	if this.tick <= 0 {
 		this.tick = this.speed
@@ -200,29 +413,72 @@ func (this *IBXM) SampleRate() int {
 
 /* Returns the song duration in samples at the current sampling rate. */
 func (this *IBXM) Length() int {
-	duration := 0
-	p := this.seqPos
-	this.SetSequencePos(0)
+	return this.SongLength().Samples
+}
+
+/* SongLength describes the duration of a song and the position it restarts from. */
+type SongLength struct {
+	Samples                  int
+	Duration                 time.Duration
+	LoopStart                int /* Samples played before the restart position is first reached. */
+	LoopStartTime            time.Duration
+	LoopSequencePos, LoopRow int
+}
+
+/* Measure the song at the current sampling rate. The current playback state is not changed. */
+func (this *IBXM) SongLength() SongLength {
+	ibxm, _ := NewIBXM(this.module, this.sampleRate)
+	rowStart := make(map[[2]int]int)
+	length := SongLength{}
 	songEnd := false
 	for !songEnd {
-		duration += this.CalculateTickLen(this.tempo, this.sampleRate)
-		songEnd = this.doTick()
+		if _, ok := rowStart[[2]int{ibxm.seqPos, ibxm.row}]; !ok {
+			rowStart[[2]int{ibxm.seqPos, ibxm.row}] = length.Samples
+		}
+		length.Samples += ibxm.CalculateTickLen(ibxm.tempo, ibxm.sampleRate)
+		songEnd = ibxm.doTick()
 	}
-	this.SetSequencePos(p)
-	return duration
+	length.LoopSequencePos = ibxm.seqPos
+	length.LoopRow = ibxm.row
+	length.LoopStart = rowStart[[2]int{ibxm.seqPos, ibxm.row}]
+	length.Duration = samplesToDuration(length.Samples, this.sampleRate)
+	length.LoopStartTime = samplesToDuration(length.LoopStart, this.sampleRate)
+	return length
+}
+
+func samplesToDuration(samples, sampleRate int) time.Duration {
+	return time.Duration(int64(samples) * int64(time.Second) / int64(sampleRate))
+}
+
+/* Returns the sequence position to restart from, or 0 if the restart position is outside the sequence. */
+func (this *IBXM) restartPos() int {
+	if this.module.restartPos < 0 || this.module.restartPos >= this.module.sequenceLength {
+		return 0
+	}
+	return this.module.restartPos
 }
 
 func (this *IBXM) doRow() bool {
 	songEnd := false
 	if this.breakSeqPos >= 0 {
 		if this.breakSeqPos >= this.module.sequenceLength {
-			this.breakSeqPos = 0
+			this.breakSeqPos = this.restartPos()
 			this.nextRow = 0
 		}
+		if this.breakSeqPos < this.startPos || (this.endPos >= 0 && this.breakSeqPos > this.endPos) {
+			this.breakSeqPos = this.startPos
+			this.nextRow = 0
+		}
+		wrapped := false
 		for this.module.sequence[this.breakSeqPos] >= this.module.numPatterns {
 			this.breakSeqPos++
 			if this.breakSeqPos >= this.module.sequenceLength {
-				this.breakSeqPos = 0
+				/* Restart, or start from the beginning if nothing after the restart position can be played. */
+				this.breakSeqPos = this.restartPos()
+				if wrapped {
+					this.breakSeqPos = 0
+				}
+				wrapped = true
 				this.nextRow = 0
 			}
 		}
@@ -234,12 +490,16 @@ func (this *IBXM) doRow() bool {
 			this.channels[idx].plRow = 0
 		}
 		this.breakSeqPos = -1
+		this.events = append(this.events, Event{Type: EVENT_ORDER,
+			SequencePos: this.seqPos, Pattern: this.module.sequence[this.seqPos]})
 	}
 	pattern := this.module.patterns[this.module.sequence[this.seqPos]]
 	this.row = this.nextRow
 	if this.row >= pattern.numRows {
 		this.row = 0
 	}
+	this.events = append(this.events, Event{Type: EVENT_ROW,
+		SequencePos: this.seqPos, Pattern: this.module.sequence[this.seqPos], Row: this.row})
 	this.nextRow = this.row + 1
 	if this.nextRow >= pattern.numRows {
 		this.breakSeqPos = this.seqPos + 1
@@ -250,31 +510,31 @@ func (this *IBXM) doRow() bool {
 		channel := this.channels[chanIdx]
 		pattern.getNote(noteIdx+chanIdx, this.note)
 		note := this.note
-		if note.effect == 0xE {
-			note.effect = 0x70 | (note.param >> 4)
-			note.param &= 0xF
+		if note.Effect == 0xE {
+			note.Effect = 0x70 | (note.Param >> 4)
+			note.Param &= 0xF
 		}
-		if note.effect == 0x93 {
-			note.effect = 0xF0 | (note.param >> 4)
-			note.param &= 0xF
+		if note.Effect == 0x93 {
+			note.Effect = 0xF0 | (note.Param >> 4)
+			note.Param &= 0xF
 		}
-		if note.effect == 0 && note.param > 0 {
-			note.effect = 0x8A
+		if note.Effect == 0 && note.Param > 0 {
+			note.Effect = 0x8A
 		}
 
 		channel.row(note)
-		switch note.effect {
+		switch note.Effect {
 		case 0x81: /* Set Speed. */
-			if note.param > 0 {
-				this.tick = note.param
-				this.speed = note.param
+			if note.Param > 0 {
+				this.tick = note.Param
+				this.speed = note.Param
 			}
 			break
 		case 0xB:
 			fallthrough
 		case 0x82: /* Pattern Jump.*/
 			if this.plCount < 0 {
-				this.breakSeqPos = note.param
+				this.breakSeqPos = note.Param
 				this.nextRow = 0
 			}
 			break
@@ -283,33 +543,33 @@ func (this *IBXM) doRow() bool {
 		case 0x83: /* Pattern Break.*/
 			if this.plCount < 0 {
 				this.breakSeqPos = this.seqPos + 1
-				this.nextRow = (note.param>>4)*10 + (note.param & 0xF)
+				this.nextRow = (note.Param>>4)*10 + (note.Param & 0xF)
 			}
 			break
 		case 0xF: /* Set Speed/Tempo.*/
-			if note.param > 0 {
-				if note.param < 32 {
-					this.tick = note.param
-					this.speed = note.param
+			if note.Param > 0 {
+				if note.Param < 32 {
+					this.tick = note.Param
+					this.speed = note.Param
 				} else {
-					this.tempo = note.param
+					this.tempo = note.Param
 				}
 			}
 			break
 		case 0x94: /* Set Tempo.*/
-			if note.param > 32 {
-				this.tempo = note.param
+			if note.Param > 32 {
+				this.tempo = note.Param
 			}
 			break
 		case 0x76:
 			fallthrough
 		case 0xFB: /* Pattern Loop.*/
-			if note.param == 0 { /* Set loop marker on this channel. */
+			if note.Param == 0 { /* Set loop marker on this channel. */
 				channel.plRow = this.row
 			}
 			if channel.plRow < this.row { /* Marker valid. Begin looping. */
 				if this.plCount < 0 { /* Not already looping, begin. */
-					this.plCount = note.param
+					this.plCount = note.Param
 					this.plChannel = chanIdx
 				}
 				if this.plChannel == chanIdx { /* Next Loop.*/
@@ -319,6 +579,8 @@ func (this *IBXM) doRow() bool {
 					} else { /* Loop and cancel any breaks on this row. */
 						this.nextRow = channel.plRow
 						this.breakSeqPos = -1
+						this.events = append(this.events, Event{Type: EVENT_PATTERN_LOOP, SequencePos: this.seqPos,
+							Pattern: this.module.sequence[this.seqPos], Row: channel.plRow, Channel: chanIdx})
 					}
 					this.plCount--
 				}
@@ -327,7 +589,7 @@ func (this *IBXM) doRow() bool {
 		case 0x7E:
 			fallthrough
 		case 0xFE: /* Pattern Delay.*/
-			this.tick = this.speed + this.speed*note.param
+			this.tick = this.speed + this.speed*note.Param
 			break
 		}
 	}
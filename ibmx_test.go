@@ -0,0 +1,78 @@
+package ibxmgo
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestRestartSkipsInvalidEntries(t *testing.T) {
+	tests := []struct {
+		sequence    []int
+		restartPos  int
+		wantLoopPos int
+	}{
+		{[]int{0, 1, 9}, 1, 1},
+		{[]int{0, 1, 9}, 0, 0},
+		{[]int{0, 9, 1}, 1, 2},
+		{[]int{0, 9, 9}, 1, 0},
+		{[]int{9, 0, 1}, 5, 1},
+	}
+	for _, test := range tests {
+		m := NewModule()
+		m.patterns = []*Pattern{NewPattern(4, 4), NewPattern(4, 4)}
+		m.numPatterns = 2
+		m.sequence = test.sequence
+		m.sequenceLength = len(test.sequence)
+		m.restartPos = test.restartPos
+		ibxm, e := NewIBXM(m, 48000)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if length := ibxm.SongLength(); length.LoopSequencePos != test.wantLoopPos {
+			t.Errorf("sequence %v restart %d: loops to %d, want %d",
+				test.sequence, test.restartPos, length.LoopSequencePos, test.wantLoopPos)
+		}
+	}
+}
+
+func TestDumpEndlessSong(t *testing.T) {
+	ibxm, e := NewIBXM(NewModule(), 48000)
+	if e != nil {
+		t.Fatal(e)
+	}
+	ibxm.SetLoopCount(0)
+	if e := ibxm.Dump(ioutil.Discard); e != EndlessSong {
+		t.Errorf("Dump: %v, want EndlessSong", e)
+	}
+	if e := ibxm.DumpStemsWAV("unused", INT16); e != EndlessSong {
+		t.Errorf("DumpStemsWAV: %v, want EndlessSong", e)
+	}
+	ibxm.SetLoopCount(1)
+	if e := ibxm.Dump(ioutil.Discard); e != nil {
+		t.Errorf("Dump: %v", e)
+	}
+}
+
+func TestEventOffset(t *testing.T) {
+	m := NewModule()
+	m.patterns[0].SetNote(2, 1, Note{Key: 49, Instrument: 1, Volume: 0x30})
+	ibxm, e := NewIBXM(m, 48000)
+	if e != nil {
+		t.Fatal(e)
+	}
+	var noteOns []Event
+	ibxm.SetEventHandler(func(event Event) {
+		if event.Type == EVENT_NOTE_ON {
+			noteOns = append(noteOns, event)
+		}
+	})
+	data := make([]int32, ibxm.AudioBufferLength())
+	for end := false; !end; {
+		_, end = ibxm.GetAudio(data)
+	}
+	want := []Event{{Type: EVENT_NOTE_ON, Offset: 0, Row: 2, Channel: 1, Key: 49, Instrument: 1, Volume: 32}}
+	if !reflect.DeepEqual(noteOns, want) {
+		t.Errorf("note on events %+v, want %+v", noteOns, want)
+	}
+}
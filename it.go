@@ -0,0 +1,698 @@
+package ibxmgo
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"math/bits"
+)
+
+var (
+	itHeader = []byte("IMPM")
+
+	itTonePortaSpeed = []int{0x00, 0x01, 0x04, 0x08, 0x10, 0x20, 0x40, 0x60, 0x80, 0xFF}
+)
+
+func IsIT(reader *bufio.Reader) bool {
+	header, e := reader.Peek(4)
+	if e != nil {
+		return false
+	}
+	return string(header) == string(itHeader)
+}
+
+func DecodeIT(reader *bufio.Reader) (*Module, error) {
+	buff, e := ioutil.ReadAll(reader)
+	if e != nil {
+		return nil, e
+	}
+	if e := checkBounds("it", buff, 0, 192, "header"); e != nil {
+		return nil, e
+	}
+	m := NewModule()
+
+	m.songName = string(buff[4:30])
+	sequenceLength := int(binary.LittleEndian.Uint16(buff[32:]))
+	numInstruments := int(binary.LittleEndian.Uint16(buff[34:]))
+	numSamples := int(binary.LittleEndian.Uint16(buff[36:]))
+	m.numPatterns = int(binary.LittleEndian.Uint16(buff[38:]))
+	compatVersion := binary.LittleEndian.Uint16(buff[42:])
+	flags := binary.LittleEndian.Uint16(buff[44:])
+	stereo := (flags & 0x1) == 0x1
+	useInstruments := (flags & 0x4) == 0x4
+	m.linearPeriods = (flags & 0x8) == 0x8
+	m.fastVolSlides = false
+	m.defaultGVol = int(buff[48]) >> 1
+	if m.defaultGVol > 64 {
+		m.defaultGVol = 64
+	}
+	m.gain = int(buff[49])
+	if m.gain > 128 {
+		m.gain = 128
+	}
+	m.defaultSpeed = int(buff[50])
+	m.defaultTempo = int(buff[51])
+	m.c2Rate = NTSC
+	if numInstruments > 255 || numSamples > 255 || m.numPatterns > 256 {
+		return nil, &DecodeError{"it", 34, "too many instruments, samples or patterns"}
+	}
+	if e := checkBounds("it", buff, 192, sequenceLength+(numInstruments+numSamples+m.numPatterns)*4, "parapointers"); e != nil {
+		return nil, e
+	}
+
+	/* Orders. 0xFF marks the end of the song, 0xFE entries are skipped by the player. */
+	m.sequence = make([]int, 0, sequenceLength)
+	for seqIdx := 0; seqIdx < sequenceLength; seqIdx++ {
+		entry := int(buff[192+seqIdx])
+		if entry == 0xFF {
+			break
+		}
+		m.sequence = append(m.sequence, entry)
+	}
+	m.sequenceLength = len(m.sequence)
+	ptrOffset := 192 + sequenceLength
+	insOffsets := make([]int, numInstruments)
+	for idx := range insOffsets {
+		insOffsets[idx] = int(binary.LittleEndian.Uint32(buff[ptrOffset:]))
+		ptrOffset += 4
+	}
+	samOffsets := make([]int, numSamples)
+	for idx := range samOffsets {
+		samOffsets[idx] = int(binary.LittleEndian.Uint32(buff[ptrOffset:]))
+		ptrOffset += 4
+	}
+	patOffsets := make([]int, m.numPatterns)
+	for idx := range patOffsets {
+		patOffsets[idx] = int(binary.LittleEndian.Uint32(buff[ptrOffset:]))
+		ptrOffset += 4
+	}
+
+	samples := make([]*Sample, numSamples+1)
+	samples[0] = &Sample{}
+	vibratos := make([][4]int, numSamples+1)
+	for samIdx := 1; samIdx <= numSamples; samIdx++ {
+		samples[samIdx], vibratos[samIdx], e = decodeITSample(buff, samOffsets[samIdx-1], m.linearPeriods)
+		if e != nil {
+			return nil, e
+		}
+	}
+
+	if useInstruments {
+		m.numInstruments = numInstruments
+		m.instruments = make([]*Instrument, numInstruments+1)
+		m.instruments[0] = DefaultInstrument()
+		for insIdx := 1; insIdx <= numInstruments; insIdx++ {
+			m.instruments[insIdx], e = decodeITInstrument(buff, insOffsets[insIdx-1], compatVersion < 0x200, samples, vibratos)
+			if e != nil {
+				return nil, e
+			}
+		}
+	} else {
+		m.numInstruments = numSamples
+		m.instruments = make([]*Instrument, numSamples+1)
+		m.instruments[0] = DefaultInstrument()
+		for samIdx := 1; samIdx <= numSamples; samIdx++ {
+			instrument := DefaultInstrument()
+			m.instruments[samIdx] = instrument
+			instrument.name = samples[samIdx].name
+			instrument.samples[0] = samples[samIdx]
+			vibrato := vibratos[samIdx]
+			instrument.vibratoType, instrument.vibratoSweep = vibrato[0], vibrato[1]
+			instrument.vibratoDepth, instrument.vibratoRate = vibrato[2], vibrato[3]
+		}
+	}
+
+	/* Patterns are unpacked 64 channels wide and narrowed to the channels in use. */
+	numChannels := 1
+	wide := make([]*Pattern, m.numPatterns)
+	for patIdx := 0; patIdx < m.numPatterns; patIdx++ {
+		pattern, maxChannel, e := decodeITPattern(buff, patOffsets[patIdx], buff[64:128])
+		if e != nil {
+			return nil, e
+		}
+		wide[patIdx] = pattern
+		if maxChannel+1 > numChannels {
+			numChannels = maxChannel + 1
+		}
+	}
+	m.numChannels = numChannels
+	m.patterns = make([]*Pattern, m.numPatterns)
+	for patIdx, src := range wide {
+		pattern := NewPattern(numChannels, src.numRows)
+		m.patterns[patIdx] = pattern
+		for rowIdx := 0; rowIdx < src.numRows; rowIdx++ {
+			copy(pattern.data[rowIdx*numChannels*5:(rowIdx+1)*numChannels*5], src.data[rowIdx*64*5:])
+		}
+	}
+	if m.numPatterns == 0 {
+		m.numPatterns = 1
+		m.patterns = []*Pattern{NewPattern(numChannels, 64)}
+	}
+	if m.sequenceLength == 0 {
+		m.sequenceLength = 1
+		m.sequence = []int{0}
+	}
+
+	m.defaultPanning = make([]int, numChannels)
+	for chanIdx := 0; chanIdx < numChannels; chanIdx++ {
+		panning := int(buff[64+chanIdx]) & 0x7F
+		if panning > 64 || !stereo {
+			panning = 32
+		}
+		m.defaultPanning[chanIdx] = panning * 255 / 64
+	}
+	if e := m.checkSequence("it"); e != nil {
+		return nil, e
+	}
+	return m, nil
+}
+
+func decodeITSample(buff []byte, offset int, linearPeriods bool) (*Sample, [4]int, error) {
+	if e := checkBounds("it", buff, offset, 80, "sample header"); e != nil {
+		return nil, [4]int{}, e
+	}
+	sample := &Sample{}
+	sample.name = string(buff[offset+20 : offset+46])
+	globalVol := int(buff[offset+17])
+	if globalVol > 64 {
+		globalVol = 64
+	}
+	flags := buff[offset+18]
+	volume := int(buff[offset+19])
+	if volume > 64 {
+		volume = 64
+	}
+	sample.volume = volume * globalVol >> 6
+	convert := buff[offset+46]
+	sample.panning = -1
+	if (buff[offset+47] & 0x80) == 0x80 {
+		panning := int(buff[offset+47] & 0x7F)
+		if panning > 64 {
+			panning = 64
+		}
+		sample.panning = panning * 255 / 64
+	}
+	sampleLength := int(binary.LittleEndian.Uint32(buff[offset+48:]))
+	loopStart := int(binary.LittleEndian.Uint32(buff[offset+52:]))
+	loopEnd := int(binary.LittleEndian.Uint32(buff[offset+56:]))
+	c5Speed := int(binary.LittleEndian.Uint32(buff[offset+60:]))
+	susLoopStart := int(binary.LittleEndian.Uint32(buff[offset+64:]))
+	susLoopEnd := int(binary.LittleEndian.Uint32(buff[offset+68:]))
+	sampleOffset := int(binary.LittleEndian.Uint32(buff[offset+72:]))
+	vibrato := [4]int{0, 0, int(buff[offset+77]) >> 2, int(buff[offset+76])}
+	switch buff[offset+79] & 0x3 { /* Sine, ramp down, square, random. */
+	case 1:
+		vibrato[0] = 3
+	case 2:
+		vibrato[0] = 1
+	case 3:
+		vibrato[0] = 4
+	}
+	if buff[offset+78] > 0 {
+		/* IT gives the depth increase per tick, XM the number of ticks to reach full depth. */
+		vibrato[1] = int(buff[offset+77]) * 256 / int(buff[offset+78])
+		if vibrato[1] > 127 {
+			vibrato[1] = 127
+		}
+	}
+
+	if c5Speed <= 0 {
+		c5Speed = int(NTSC)
+	}
+	sample.c2Rate = C2Rate(c5Speed)
+	if linearPeriods {
+		tune := int(math.Floor(math.Log2(float64(c5Speed)/float64(NTSC))*12*128 + 0.5))
+		sample.relNote = tune >> 7
+		sample.fineTune = tune & 0x7F
+	}
+
+	if (flags & 0x1) == 0 {
+		sample.setSampleData(nil, 0, 0, false)
+		return sample, vibrato, nil
+	}
+	sixteenBit := (flags & 0x2) == 0x2
+	compressed := (flags & 0x8) == 0x8
+	if compressed {
+		/* Compressed data can not be smaller than a bit per sample. */
+		if maxLength := available(buff, sampleOffset, sampleLength, 1) * 8; sampleLength > maxLength {
+			sampleLength = maxLength
+		}
+	} else if sixteenBit {
+		sampleLength = available(buff, sampleOffset, sampleLength, 2)
+	} else {
+		sampleLength = available(buff, sampleOffset, sampleLength, 1)
+	}
+	looped := (flags & 0x10) == 0x10
+	pingPong := (flags & 0x40) == 0x40
+	if !looped && (flags&0x20) == 0x20 {
+		/* Sustain loops are played as ordinary loops. */
+		looped = true
+		pingPong = (flags & 0x80) == 0x80
+		loopStart, loopEnd = susLoopStart, susLoopEnd
+	}
+	if !looped || loopEnd <= loopStart || loopEnd > sampleLength {
+		loopStart = sampleLength
+		loopEnd = sampleLength
+		pingPong = false
+	}
+
+	signed := (convert & 0x1) == 0x1
+	sampleData := make([]int16, sampleLength)
+	if compressed {
+		if sampleLength > 0 {
+			decodeITCompressed(buff[sampleOffset:], sampleData, sixteenBit, (convert&0x4) == 0x4)
+		}
+	} else if sixteenBit {
+		ampl := 0
+		for idx := 0; idx < sampleLength; idx++ {
+			sam := int(int16(binary.LittleEndian.Uint16(buff[sampleOffset:])))
+			if !signed {
+				sam = int(binary.LittleEndian.Uint16(buff[sampleOffset:])) - 32768
+			}
+			if (convert & 0x4) == 0x4 {
+				ampl += sam
+				sam = ampl
+			}
+			sampleData[idx] = int16(sam)
+			sampleOffset += 2
+		}
+	} else {
+		ampl := 0
+		for idx := 0; idx < sampleLength; idx++ {
+			sam := int(int8(buff[sampleOffset]))
+			if !signed {
+				sam = int(buff[sampleOffset]) - 128
+			}
+			if (convert & 0x4) == 0x4 {
+				ampl += sam
+				sam = ampl
+			}
+			sampleData[idx] = int16(int8(sam)) << 8
+			sampleOffset++
+		}
+	}
+	sample.setSampleData(sampleData, loopStart, loopEnd-loopStart, pingPong)
+	return sample, vibrato, nil
+}
+
+/* Unpack IT 2.14/2.15 compressed sample data into out. */
+func decodeITCompressed(buff []byte, out []int16, sixteenBit, it215 bool) {
+	blockLen, startWidth := 0x8000, 9
+	if sixteenBit {
+		blockLen, startWidth = 0x4000, 17
+	}
+	inOffset, outOffset := 0, 0
+	for outOffset < len(out) {
+		if inOffset+2 > len(buff) {
+			return
+		}
+		compressedLen := int(binary.LittleEndian.Uint16(buff[inOffset:]))
+		inOffset += 2
+		end := inOffset + compressedLen
+		if end > len(buff) {
+			end = len(buff)
+		}
+		bits := &itBitReader{buff: buff[inOffset:end]}
+		inOffset = end
+		count := len(out) - outOffset
+		if count > blockLen {
+			count = blockLen
+		}
+		width := startWidth
+		d1, d2 := 0, 0
+		for idx := 0; idx < count; {
+			if width < 1 || width > startWidth || bits.exhausted() {
+				break
+			}
+			value := bits.read(width)
+			if width < 7 { /* Method 1, 1 to 6 bits. */
+				if value == 1<<uint(width-1) {
+					if sixteenBit {
+						value = bits.read(4) + 1
+					} else {
+						value = bits.read(3) + 1
+					}
+					width = itNextWidth(value, width)
+					continue
+				}
+			} else if width < startWidth { /* Method 2, 7 to 8 (16) bits. */
+				border := (0xFF >> uint(9-width)) - 4
+				if sixteenBit {
+					border = (0xFFFF >> uint(17-width)) - 8
+				}
+				if value > border && value <= border+(startWidth-1) {
+					width = itNextWidth(value-border, width)
+					continue
+				}
+			} else { /* Method 3, 9 (17) bits. */
+				if (value & (1 << uint(startWidth-1))) != 0 {
+					width = (value + 1) & 0xFF
+					continue
+				}
+			}
+			/* Sign-extend the value to the sample width. */
+			shift := uint(startWidth - 1 - width)
+			if width >= startWidth-1 {
+				shift = 0
+			}
+			if sixteenBit {
+				d1 += int(int16(value<<shift) >> shift)
+			} else {
+				d1 += int(int8(value<<shift) >> shift)
+			}
+			d2 += d1
+			ampl := d1
+			if it215 {
+				ampl = d2
+			}
+			if sixteenBit {
+				out[outOffset+idx] = int16(ampl)
+			} else {
+				out[outOffset+idx] = int16(int8(ampl)) << 8
+			}
+			idx++
+		}
+		outOffset += count
+	}
+}
+
+func itNextWidth(value, width int) int {
+	if value < width {
+		return value
+	}
+	return value + 1
+}
+
+type itBitReader struct {
+	buff           []byte
+	offset, bitPos int
+}
+
+func (this *itBitReader) exhausted() bool {
+	return this.offset >= len(this.buff)
+}
+
+func (this *itBitReader) read(count int) int {
+	value := 0
+	for bit := 0; bit < count; bit++ {
+		if this.offset >= len(this.buff) {
+			break
+		}
+		value |= int(this.buff[this.offset]>>uint(this.bitPos)&1) << uint(bit)
+		this.bitPos++
+		if this.bitPos == 8 {
+			this.bitPos = 0
+			this.offset++
+		}
+	}
+	return value
+}
+
+func decodeITInstrument(buff []byte, offset int, oldFormat bool, samples []*Sample, vibratos [][4]int) (*Instrument, error) {
+	if e := checkBounds("it", buff, offset, 554, "instrument header"); e != nil {
+		return nil, e
+	}
+	instrument := &Instrument{}
+	instrument.name = string(buff[offset+32 : offset+58])
+	globalVol, panning := 128, -1
+	volEnv := &Envelope{}
+	panEnv := DefaultEnvelope()
+	if oldFormat {
+		instrument.volumeFadeOut = int(binary.LittleEndian.Uint16(buff[offset+24:])) << 6
+		envFlags := buff[offset+17]
+		volEnv.pointsTick = make([]int, 25)
+		volEnv.pointsAmpl = make([]int, 25)
+		for point := 0; point < 25; point++ {
+			pointOffset := offset + 504 + point*2
+			if buff[pointOffset] == 0xFF {
+				break
+			}
+			volEnv.pointsTick[point] = int(buff[pointOffset])
+			volEnv.pointsAmpl[point] = int(buff[pointOffset+1])
+			volEnv.numPoints++
+		}
+		decodeITEnvelopeFlags(volEnv, envFlags, buff[offset+18], buff[offset+19], buff[offset+20], buff[offset+21])
+	} else {
+		instrument.volumeFadeOut = int(binary.LittleEndian.Uint16(buff[offset+20:])) << 5
+		globalVol = int(buff[offset+24])
+		if globalVol > 128 {
+			globalVol = 128
+		}
+		if (buff[offset+25] & 0x80) == 0 {
+			panning = int(buff[offset+25] & 0x7F)
+			if panning > 64 {
+				panning = 64
+			}
+			panning = panning * 255 / 64
+		}
+		decodeITEnvelope(volEnv, buff[offset+304:], 0)
+		panEnv = &Envelope{}
+		decodeITEnvelope(panEnv, buff[offset+386:], 32)
+	}
+	instrument.volumeEnvelope = volEnv
+	instrument.panningEnvelope = panEnv
+
+	/* Each instrument gets its own copies of the samples it maps, so that
+	   instrument volume, panning and note translation can be folded into them. */
+	instrument.samples = []*Sample{&Sample{}}
+	sampleMap := make(map[[2]int]int)
+	for note := 0; note < 120; note++ {
+		transpose := int(buff[offset+64+note*2]) - note
+		samIdx := int(buff[offset+64+note*2+1])
+		key := note - 11
+		if samIdx < 1 || samIdx >= len(samples) || key < 1 || key > 96 {
+			continue
+		}
+		idx, ok := sampleMap[[2]int{samIdx, transpose}]
+		if !ok {
+			sample := *samples[samIdx]
+			sample.volume = sample.volume * globalVol >> 7
+			if sample.panning < 0 {
+				sample.panning = panning
+			}
+			sample.relNote += transpose
+			idx = len(instrument.samples)
+			sampleMap[[2]int{samIdx, transpose}] = idx
+			instrument.samples = append(instrument.samples, &sample)
+			if idx == 1 {
+				vibrato := vibratos[samIdx]
+				instrument.vibratoType, instrument.vibratoSweep = vibrato[0], vibrato[1]
+				instrument.vibratoDepth, instrument.vibratoRate = vibrato[2], vibrato[3]
+			}
+		}
+		instrument.keyToSample[key] = idx
+	}
+	instrument.numSamples = len(instrument.samples)
+	return instrument, nil
+}
+
+func decodeITEnvelope(env *Envelope, buff []byte, amplOffset int) {
+	env.numPoints = int(buff[1])
+	if env.numPoints > 25 {
+		env.numPoints = 0
+	}
+	env.pointsTick = make([]int, 25)
+	env.pointsAmpl = make([]int, 25)
+	for point := 0; point < 25; point++ {
+		env.pointsAmpl[point] = int(int8(buff[6+point*3])) + amplOffset
+		env.pointsTick[point] = int(binary.LittleEndian.Uint16(buff[7+point*3:]))
+	}
+	decodeITEnvelopeFlags(env, buff[0], buff[2], buff[3], buff[4], buff[5])
+}
+
+func decodeITEnvelopeFlags(env *Envelope, flags, loopStart, loopEnd, susStart, susEnd byte) {
+	if env.numPoints < 1 {
+		env.numPoints = 1
+		env.pointsAmpl[0] = 64
+		return
+	}
+	last := byte(env.numPoints - 1)
+	if loopStart > last || loopEnd > last {
+		flags &^= 0x2
+		loopStart, loopEnd = 0, 0
+	}
+	if susStart > last || susEnd > last {
+		flags &^= 0x4
+		susStart = 0
+	}
+	env.enabled = (flags & 0x1) == 0x1
+	env.looped = (flags & 0x2) == 0x2
+	/* Sustain loops are approximated by holding at the start of the loop. */
+	env.sustain = (flags & 0x4) == 0x4
+	env.loopStartTick = env.pointsTick[loopStart]
+	env.loopEndTick = env.pointsTick[loopEnd]
+	env.sustainTick = env.pointsTick[susStart]
+	env.checkPoints()
+}
+
+/* Unpack an IT pattern 64 channels wide. The highest channel containing data is also returned. */
+func decodeITPattern(buff []byte, offset int, channelPan []byte) (*Pattern, int, error) {
+	if offset == 0 {
+		return NewPattern(64, 64), 0, nil
+	}
+	if e := checkBounds("it", buff, offset, 8, "pattern header"); e != nil {
+		return nil, 0, e
+	}
+	numRows := int(binary.LittleEndian.Uint16(buff[offset+2:]))
+	if numRows < 1 {
+		numRows = 64
+	}
+	if numRows > 1024 {
+		return nil, 0, &DecodeError{"it", offset + 2, "too many rows in pattern"}
+	}
+	pattern := NewPattern(64, numRows)
+	maxChannel := 0
+	var masks [64]byte
+	var last [64][5]byte
+	inOffset := offset + 8
+	for rowIdx := 0; rowIdx < numRows; {
+		if e := checkBounds("it", buff, inOffset, 1, "pattern data"); e != nil {
+			return nil, 0, e
+		}
+		token := buff[inOffset]
+		inOffset++
+		if token == 0 {
+			rowIdx++
+			continue
+		}
+		chanIdx := int(token-1) & 0x3F
+		if (token & 0x80) == 0x80 {
+			if e := checkBounds("it", buff, inOffset, 1, "pattern data"); e != nil {
+				return nil, 0, e
+			}
+			masks[chanIdx] = buff[inOffset]
+			inOffset++
+		}
+		mask := masks[chanIdx]
+		if e := checkBounds("it", buff, inOffset, bits.OnesCount8(mask&0x7)+bits.OnesCount8(mask&0x8)*2, "pattern data"); e != nil {
+			return nil, 0, e
+		}
+		lastNote := &last[chanIdx]
+		if (mask & 0x1) == 0x1 {
+			lastNote[0] = buff[inOffset]
+			inOffset++
+		}
+		if (mask & 0x2) == 0x2 {
+			lastNote[1] = buff[inOffset]
+			inOffset++
+		}
+		if (mask & 0x4) == 0x4 {
+			lastNote[2] = buff[inOffset]
+			inOffset++
+		}
+		if (mask & 0x8) == 0x8 {
+			lastNote[3] = buff[inOffset]
+			lastNote[4] = buff[inOffset+1]
+			inOffset += 2
+		}
+		if channelPan[chanIdx] >= 128 { /* Disabled channel. */
+			continue
+		}
+		note := Note{}
+		if (mask & 0x11) != 0 {
+			note.Key = int(lastNote[0])
+		} else {
+			note.Key = -1
+		}
+		if (mask & 0x22) != 0 {
+			note.Instrument = int(lastNote[1])
+		}
+		note.Volume = -1
+		if (mask & 0x44) != 0 {
+			note.Volume = int(lastNote[2])
+		}
+		if (mask & 0x88) != 0 {
+			note.Effect = int(lastNote[3])
+			note.Param = int(lastNote[4])
+		}
+		convertITNote(&note)
+		noteOffset := (rowIdx*64 + chanIdx) * 5
+		pattern.data[noteOffset] = byte(note.Key)
+		pattern.data[noteOffset+1] = byte(note.Instrument)
+		pattern.data[noteOffset+2] = byte(note.Volume)
+		pattern.data[noteOffset+3] = byte(note.Effect)
+		pattern.data[noteOffset+4] = byte(note.Param)
+		if chanIdx > maxChannel {
+			maxChannel = chanIdx
+		}
+	}
+	return pattern, maxChannel, nil
+}
+
+/* Convert an IT note (key and volume are -1 when absent) to the effect numbering used by the S3M decoder. */
+func convertITNote(note *Note) {
+	key := note.Key
+	note.Key = 0
+	switch {
+	case key < 0:
+	case key < 120:
+		if key-11 >= 1 && key-11 <= 96 {
+			note.Key = key - 11
+		}
+	case key == 0xFE: /* Note cut. */
+		note.Key = 97
+		if note.Volume < 0 {
+			note.Volume = 0
+		}
+	default: /* Note off or fade. */
+		note.Key = 97
+	}
+
+	effect, param := note.Effect, note.Param
+	switch effect {
+	case 0x16: /* Set Global Volume. */
+		effect, param = 0x96, param>>1
+	case 0x17: /* Global Volume Slide. */
+		effect = 0x11
+	case 0x10: /* Panning Slide. */
+		effect, param = 0x19, (param>>4)|((param&0xF)<<4)
+	case 0x18: /* Set Panning. */
+		effect = 0x08
+	case 0x0D, 0x0E, 0x19, 0x1A: /* Channel volume, panbrello and MIDI macros are not supported. */
+		effect, param = 0, 0
+	default:
+		if effect < 1 || effect > 0x1A {
+			effect, param = 0, 0
+		} else {
+			effect += 0x80
+		}
+	}
+
+	vol := note.Volume
+	note.Volume = 0
+	switch {
+	case vol < 0:
+	case vol <= 64: /* Set Volume. */
+		note.Volume = 0x10 + vol
+	case vol <= 74: /* Fine Vol Up. */
+		note.Volume = 0x90 | (vol - 65)
+	case vol <= 84: /* Fine Vol Down. */
+		note.Volume = 0x80 | (vol - 75)
+	case vol <= 94: /* Vol Slide Up. */
+		note.Volume = 0x70 | (vol - 85)
+	case vol <= 104: /* Vol Slide Down. */
+		note.Volume = 0x60 | (vol - 95)
+	case vol <= 114: /* Porta Down. */
+		if effect == 0 {
+			effect, param = 0x85, (vol-105)<<2
+		}
+	case vol <= 124: /* Porta Up. */
+		if effect == 0 {
+			effect, param = 0x86, (vol-115)<<2
+		}
+	case vol >= 128 && vol <= 192: /* Set Panning. */
+		pan := (vol - 128) >> 2
+		if pan > 15 {
+			pan = 15
+		}
+		note.Volume = 0xC0 | pan
+	case vol >= 193 && vol <= 202: /* Tone Porta. */
+		if effect == 0 {
+			effect, param = 0x87, itTonePortaSpeed[vol-193]
+		}
+	case vol >= 203 && vol <= 212: /* Vibrato. */
+		note.Volume = 0xB0 | (vol - 203)
+	}
+	note.Effect, note.Param = effect, param
+}
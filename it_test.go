@@ -0,0 +1,300 @@
+package ibxmgo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+/* Writes values of any width least significant bit first, as IT compressed samples are stored. */
+type itBitWriter struct {
+	buff    []byte
+	numBits int
+}
+
+func (this *itBitWriter) write(value, width int) {
+	for bit := 0; bit < width; bit++ {
+		if this.numBits%8 == 0 {
+			this.buff = append(this.buff, 0)
+		}
+		if (value>>uint(bit))&1 == 1 {
+			this.buff[len(this.buff)-1] |= 1 << uint(this.numBits%8)
+		}
+		this.numBits++
+	}
+}
+
+/* Returns a compressed sample block with its length prefix. */
+func (this *itBitWriter) block() []byte {
+	return append(binary.LittleEndian.AppendUint16(nil, uint16(len(this.buff))), this.buff...)
+}
+
+func itSampleHeader(name string, flags, convert, panning byte, length, loopStart, loopEnd int) []byte {
+	header := make([]byte, 80)
+	copy(header, "IMPS")
+	header[17], header[18], header[19] = 64, flags, 64
+	copy(header[20:46], name)
+	header[46], header[47] = convert, panning
+	binary.LittleEndian.PutUint32(header[48:], uint32(length))
+	binary.LittleEndian.PutUint32(header[60:], uint32(NTSC))
+	if (flags & 0x20) == 0x20 {
+		binary.LittleEndian.PutUint32(header[64:], uint32(loopStart))
+		binary.LittleEndian.PutUint32(header[68:], uint32(loopEnd))
+	} else {
+		binary.LittleEndian.PutUint32(header[52:], uint32(loopStart))
+		binary.LittleEndian.PutUint32(header[56:], uint32(loopEnd))
+	}
+	return header
+}
+
+/* Returns an Impulse Tracker module with an instrument mapping a plain 8-bit, a compressed 8-bit and a compressed 16-bit sample, a packed 4-row pattern playing note on channel 0, and an empty pattern. The instrument has the given new note action. Channel 2 is disabled. */
+func itModule(note, newNoteAction byte) []byte {
+	buff := make([]byte, 192)
+	copy(buff, "IMPMimpulse")
+	binary.LittleEndian.PutUint16(buff[32:], 3)
+	binary.LittleEndian.PutUint16(buff[34:], 1)
+	binary.LittleEndian.PutUint16(buff[36:], 3)
+	binary.LittleEndian.PutUint16(buff[38:], 2)
+	binary.LittleEndian.PutUint16(buff[42:], 0x214)
+	binary.LittleEndian.PutUint16(buff[44:], 0xD)
+	buff[48], buff[49], buff[50], buff[51] = 128, 48, 6, 125
+	for chanIdx := 0; chanIdx < 64; chanIdx++ {
+		buff[64+chanIdx] = 0xA0
+	}
+	copy(buff[64:], []byte{0, 64, 0x90, 32})
+	buff = append(buff, 0, 1, 0xFF)
+	pointers := len(buff)
+	buff = append(buff, make([]byte, 6*4)...)
+	pointer := func(idx int) {
+		binary.LittleEndian.PutUint32(buff[pointers+idx*4:], uint32(len(buff)))
+	}
+
+	pointer(0)
+	instrument := make([]byte, 554)
+	copy(instrument, "IMPI")
+	instrument[17] = newNoteAction
+	binary.LittleEndian.PutUint16(instrument[20:], 4)
+	instrument[24], instrument[25] = 64, 32
+	copy(instrument[32:58], "translated")
+	for note := 0; note < 120; note++ {
+		translated, sample := note, 1
+		switch {
+		case note >= 84:
+			translated, sample = note-1, 3
+		case note >= 72:
+			sample = 2
+		case note >= 60:
+			translated, sample = note+12, 2
+		}
+		instrument[64+note*2], instrument[65+note*2] = byte(translated), byte(sample)
+	}
+	/* Volume envelope with a loop and a sustain point, panning envelope from left to right. */
+	copy(instrument[304:], []byte{0x7, 3, 1, 2, 0, 0, 64, 0, 0, 32, 10, 0, 16, 20, 0})
+	copy(instrument[386:], []byte{0x1, 2, 0, 0, 0, 0, 0xE0, 0, 0, 32, 8, 0})
+	buff = append(buff, instrument...)
+
+	pointer(1)
+	header := itSampleHeader("plain", 0x11, 0x1, 0, 16, 4, 12)
+	header[76], header[77], header[78], header[79] = 10, 8, 4, 1
+	binary.LittleEndian.PutUint32(header[72:], uint32(len(buff)+80))
+	buff = append(buff, header...)
+	for idx := 0; idx < 16; idx++ {
+		buff = append(buff, byte(idx*8))
+	}
+
+	pointer(2)
+	header = itSampleHeader("compressed", 0x9, 0x1, 0, 12, 0, 0)
+	binary.LittleEndian.PutUint32(header[72:], uint32(len(buff)+80))
+	buff = append(buff, header...)
+	bits := &itBitWriter{}
+	for _, delta := range []int{0, 10, 10, 10} {
+		bits.write(delta, 9)
+	}
+	bits.write(0x103, 9) /* Width 4. */
+	for idx := 0; idx < 4; idx++ {
+		bits.write(-1, 4)
+	}
+	bits.write(8, 4) /* Width 9. */
+	bits.write(7, 3)
+	for _, delta := range []int{-50, 0, 0, 0} {
+		bits.write(delta&0xFF, 9)
+	}
+	buff = append(buff, bits.block()...)
+
+	pointer(3)
+	header = itSampleHeader("sixteen", 0xAB, 0x5, 0x80|64, 8, 2, 6)
+	binary.LittleEndian.PutUint32(header[72:], uint32(len(buff)+80))
+	buff = append(buff, header...)
+	bits = &itBitWriter{}
+	for idx := 0; idx < 8; idx++ {
+		bits.write(100, 17)
+	}
+	buff = append(buff, bits.block()...)
+
+	pointer(4)
+	pattern := []byte{
+		0x81, 0x0F, note, 1, 32, 1, 3, 0x82, 0x03, 71, 1, 0x83, 0x01, 50, 0,
+		0x81, 0xF0, 0x82, 0x01, 0xFE, 0x84, 0x05, 0xFF, 195, 0,
+		0x01, 0x82, 0x08, 20, 0x80, 0,
+		0,
+	}
+	buff = binary.LittleEndian.AppendUint16(buff, uint16(len(pattern)))
+	buff = binary.LittleEndian.AppendUint16(buff, 4)
+	buff = append(buff, make([]byte, 4)...)
+	return append(buff, pattern...)
+}
+
+func TestDecodeIT(t *testing.T) {
+	m, e := Decode(bytes.NewReader(itModule(60, 1)))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if m.Format() != "it" || m.NumChannels() != 4 || !m.LinearPeriods() || m.FastVolumeSlides() {
+		t.Errorf("format %q with %d channels", m.Format(), m.NumChannels())
+	}
+	if m.DefaultSpeed() != 6 || m.DefaultTempo() != 125 || m.DefaultGlobalVolume() != 64 || m.Gain() != 48 {
+		t.Errorf("speed %d, tempo %d, global volume %d, gain %d",
+			m.DefaultSpeed(), m.DefaultTempo(), m.DefaultGlobalVolume(), m.Gain())
+	}
+	if panning := m.DefaultPanning(); !reflect.DeepEqual(panning, []int{0, 255, 63, 127}) {
+		t.Errorf("panning %v", panning)
+	}
+	if sequence := m.Sequence(); !reflect.DeepEqual(sequence, []int{0, 1}) {
+		t.Errorf("sequence %v, want [0 1]", sequence)
+	}
+	patterns := m.Patterns()
+	if len(patterns) != 2 || patterns[0].NumRows() != 4 || patterns[1].NumRows() != 64 {
+		t.Fatalf("%d patterns", len(patterns))
+	}
+
+	/* Rows 1 and 2 of channel 0 repeat row 0 from the last values, channel 2 is disabled. */
+	first := Note{Key: 49, Instrument: 1, Volume: 0x30, Effect: 0x81, Param: 3}
+	want := map[[2]int]Note{
+		{0, 0}: first,
+		{0, 1}: {Key: 60, Instrument: 1},
+		{1, 0}: first,
+		{1, 1}: {Key: 97, Volume: 0x10},
+		{1, 3}: {Key: 97, Effect: 0x87, Param: 4},
+		{2, 0}: first,
+		{2, 1}: {Effect: 0x94, Param: 0x80},
+	}
+	for row := 0; row < 4; row++ {
+		for chanIdx := 0; chanIdx < 4; chanIdx++ {
+			if note := patterns[0].Note(row, chanIdx); note != want[[2]int{row, chanIdx}] {
+				t.Errorf("row %d channel %d: %+v, want %+v", row, chanIdx, note, want[[2]int{row, chanIdx}])
+			}
+		}
+	}
+	for row := 0; row < 64; row++ {
+		for chanIdx := 0; chanIdx < 4; chanIdx++ {
+			if note := patterns[1].Note(row, chanIdx); note != (Note{}) {
+				t.Errorf("empty pattern row %d channel %d: %+v", row, chanIdx, note)
+			}
+		}
+	}
+
+	instrument := m.Instruments()[0]
+	if instrument.Name() != "translated" || instrument.VolumeFadeOut() != 128 {
+		t.Errorf("instrument %q, fade out %d", instrument.Name(), instrument.VolumeFadeOut())
+	}
+	if waveform, sweep, depth, rate := instrument.Vibrato(); waveform != 3 || sweep != 127 || depth != 2 || rate != 10 {
+		t.Errorf("vibrato %d %d %d %d", waveform, sweep, depth, rate)
+	}
+	volEnv := instrument.VolumeEnvelope()
+	if points := volEnv.Points(); !volEnv.Enabled() || !reflect.DeepEqual(points, []EnvelopePoint{{0, 64}, {10, 32}, {20, 16}}) {
+		t.Errorf("volume envelope %v", points)
+	}
+	if enabled, start, end := volEnv.Loop(); !enabled || start != 10 || end != 20 {
+		t.Errorf("volume envelope loop %v %d-%d", enabled, start, end)
+	}
+	if enabled, tick := volEnv.Sustain(); !enabled || tick != 0 {
+		t.Errorf("volume envelope sustain %v %d", enabled, tick)
+	}
+	panEnv := instrument.PanningEnvelope()
+	if points := panEnv.Points(); !panEnv.Enabled() || !reflect.DeepEqual(points, []EnvelopePoint{{0, 0}, {8, 64}}) {
+		t.Errorf("panning envelope %v", points)
+	}
+
+	/* Keys map to a copy of each sample for every note translation. */
+	keys := []struct {
+		key, samIdx, relNote int
+	}{
+		{1, 1, 0}, {48, 1, 0}, {49, 2, 12}, {60, 2, 12}, {61, 3, 0}, {72, 3, 0}, {73, 4, -1}, {96, 4, -1},
+	}
+	samples := instrument.Samples()
+	if len(samples) != 5 {
+		t.Fatalf("%d samples, want 5", len(samples))
+	}
+	for _, test := range keys {
+		samIdx := instrument.KeyToSample(test.key)
+		if samIdx != test.samIdx || samples[samIdx].RelNote() != test.relNote {
+			t.Errorf("key %d: sample %d with relative note %d, want sample %d with %d",
+				test.key, samIdx, samples[samIdx].RelNote(), test.samIdx, test.relNote)
+		}
+	}
+
+	plain := make([]int16, 12)
+	for idx := range plain {
+		plain[idx] = int16(idx*8) << 8
+	}
+	compressed := []int16{0, 10, 20, 30, 29, 28, 27, 26, -24, -24, -24, -24}
+	for idx := range compressed {
+		compressed[idx] <<= 8
+	}
+	/* Ping-pong loops are unrolled. */
+	sixteenBit := []int16{100, 300, 600, 1000, 1500, 2100, 2100, 1500, 1000, 600}
+	tests := []struct {
+		data                  []int16
+		loopStart, loopLength int
+		pingPong              bool
+		panning               int
+	}{
+		{plain, 4, 8, false, 127},
+		{compressed, 0, 0, false, 127},
+		{compressed, 0, 0, false, 127},
+		{sixteenBit, 2, 8, true, 255},
+	}
+	for idx, test := range tests {
+		sample := samples[idx+1]
+		if data := sample.Data(); !reflect.DeepEqual(data, test.data) {
+			t.Errorf("sample %d: data %v", idx+1, data)
+		}
+		if start, length := sample.Loop(); start != test.loopStart || length != test.loopLength || sample.PingPong() != test.pingPong {
+			t.Errorf("sample %d: loop %d+%d ping-pong %v", idx+1, start, length, sample.PingPong())
+		}
+		if sample.Volume() != 32 || sample.Panning() != test.panning {
+			t.Errorf("sample %d: volume %d, panning %d", idx+1, sample.Volume(), sample.Panning())
+		}
+	}
+}
+
+func itPlayback(t *testing.T, data []byte) []byte {
+	m, e := Decode(bytes.NewReader(data))
+	if e != nil {
+		t.Fatal(e)
+	}
+	ibxm, e := NewIBXM(m, 48000)
+	if e != nil {
+		t.Fatal(e)
+	}
+	var out bytes.Buffer
+	if e := ibxm.Dump(&out); e != nil {
+		t.Fatal(e)
+	}
+	return out.Bytes()
+}
+
+func TestITNoteTranslation(t *testing.T) {
+	/* Note 60 is translated up an octave to the same sample as note 72. */
+	if !bytes.Equal(itPlayback(t, itModule(60, 0)), itPlayback(t, itModule(72, 0))) {
+		t.Errorf("translated note plays differently")
+	}
+}
+
+func TestITNewNoteActionIgnored(t *testing.T) {
+	/* Playback has one voice per channel, so "continue" plays as "cut". */
+	if !bytes.Equal(itPlayback(t, itModule(60, 0)), itPlayback(t, itModule(60, 1))) {
+		t.Errorf("new note action changes playback")
+	}
+}
@@ -5,9 +5,11 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
-	//	"fmt"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math/bits"
+	"strings"
 )
 
 type C2Rate int
@@ -36,6 +38,9 @@ var (
 	formats           []format
 	deltaEnvHeader    = []byte("DigiBooster Pro")
 	UnsupportedFormat = errors.New("Unsupported format")
+	ValueOutOfRange   = errors.New("Value out of range")
+	IndexOutOfRange   = errors.New("Index out of range")
+	ChannelMismatch   = errors.New("Pattern channel count does not match module")
 
 	keyToPeriod = []int{
 		29020, 27392, 25855, 24403, 23034, 21741, 20521,
@@ -43,6 +48,36 @@ var (
 	}
 )
 
+/* DecodeError is returned when a module file is malformed or truncated. */
+type DecodeError struct {
+	Format string
+	Offset int
+	Reason string
+}
+
+func (this *DecodeError) Error() string {
+	return fmt.Sprintf("%s: %s at offset %d", this.Format, this.Reason, this.Offset)
+}
+
+/* Returns a DecodeError unless length bytes from offset are within buff. */
+func checkBounds(format string, buff []byte, offset, length int, what string) error {
+	if offset < 0 || length < 0 || offset+length > len(buff) {
+		return &DecodeError{format, offset, "truncated " + what}
+	}
+	return nil
+}
+
+/* Returns the number of length-byte units available from offset, at most count. */
+func available(buff []byte, offset, count, length int) int {
+	if offset < 0 || offset >= len(buff) {
+		return 0
+	}
+	if avail := (len(buff) - offset) / length; avail < count {
+		return avail
+	}
+	return count
+}
+
 type format struct {
 	name   string
 	check  func(r *bufio.Reader) bool
@@ -71,8 +106,133 @@ func DefaultInstrument() *Instrument {
 	}
 }
 
+/* Returns the instrument name with padding removed. */
+func (this *Instrument) Name() string {
+	return trimName(this.name)
+}
+
+/* Returns the samples of the instrument. */
+func (this *Instrument) Samples() []*Sample {
+	return append([]*Sample(nil), this.samples[:this.numSamples]...)
+}
+
+/* Returns the index into Samples() played for key (1 to 96). */
+func (this *Instrument) KeyToSample(key int) int {
+	if key < 0 || key >= len(this.keyToSample) {
+		return 0
+	}
+	return this.keyToSample[key]
+}
+
+func (this *Instrument) VolumeEnvelope() *Envelope {
+	return this.volumeEnvelope
+}
+
+func (this *Instrument) PanningEnvelope() *Envelope {
+	return this.panningEnvelope
+}
+
+func (this *Instrument) VolumeFadeOut() int {
+	return this.volumeFadeOut
+}
+
+/* Returns the auto-vibrato waveform, sweep, depth and rate. */
+func (this *Instrument) Vibrato() (waveform, sweep, depth, rate int) {
+	return this.vibratoType, this.vibratoSweep, this.vibratoDepth, this.vibratoRate
+}
+
+func (this *Instrument) SetName(name string) {
+	this.name = name
+}
+
+/* Returns ValueOutOfRange if the instrument has no samples or envelopes, such as the zero Instrument. */
+func (this *Instrument) check() error {
+	if this == nil || this.numSamples < 1 || this.numSamples > len(this.samples) {
+		return ValueOutOfRange
+	}
+	for _, sample := range this.samples[:this.numSamples] {
+		if sample == nil {
+			return ValueOutOfRange
+		}
+	}
+	if this.volumeEnvelope == nil || this.panningEnvelope == nil {
+		return ValueOutOfRange
+	}
+	return nil
+}
+
+/* Replaces the samples of the instrument. Keys mapped to removed samples are mapped to the first sample. */
+func (this *Instrument) SetSamples(samples []*Sample) error {
+	if len(samples) < 1 {
+		return ValueOutOfRange
+	}
+	for _, sample := range samples {
+		if sample == nil {
+			return ValueOutOfRange
+		}
+	}
+	this.samples = append([]*Sample(nil), samples...)
+	this.numSamples = len(samples)
+	for key, samIdx := range this.keyToSample {
+		if samIdx >= this.numSamples {
+			this.keyToSample[key] = 0
+		}
+	}
+	return nil
+}
+
+/* Sets the index into Samples() played for key (1 to 96). */
+func (this *Instrument) SetKeyToSample(key, samIdx int) error {
+	if key < 1 || key > 96 {
+		return IndexOutOfRange
+	}
+	if samIdx < 0 || samIdx >= this.numSamples {
+		return IndexOutOfRange
+	}
+	this.keyToSample[key] = samIdx
+	return nil
+}
+
+func (this *Instrument) SetVolumeEnvelope(envelope *Envelope) error {
+	if envelope == nil {
+		return ValueOutOfRange
+	}
+	this.volumeEnvelope = envelope
+	return nil
+}
+
+func (this *Instrument) SetPanningEnvelope(envelope *Envelope) error {
+	if envelope == nil {
+		return ValueOutOfRange
+	}
+	this.panningEnvelope = envelope
+	return nil
+}
+
+/* Sets the volume decrease per tick after key off (0 to 32768). */
+func (this *Instrument) SetVolumeFadeOut(fadeOut int) error {
+	if fadeOut < 0 || fadeOut > 32768 {
+		return ValueOutOfRange
+	}
+	this.volumeFadeOut = fadeOut
+	return nil
+}
+
+/* Sets the auto-vibrato waveform (0 to 3), sweep, depth and rate (0 to 255). */
+func (this *Instrument) SetVibrato(waveform, sweep, depth, rate int) error {
+	if waveform < 0 || waveform > 3 {
+		return ValueOutOfRange
+	}
+	if sweep < 0 || sweep > 255 || depth < 0 || depth > 255 || rate < 0 || rate > 255 {
+		return ValueOutOfRange
+	}
+	this.vibratoType, this.vibratoSweep, this.vibratoDepth, this.vibratoRate = waveform, sweep, depth, rate
+	return nil
+}
+
+/* Module is a song, as decoded or built with the setters. An IBXM reads the module as it plays, so it must not be changed while an IBXM is using it. */
 type Module struct {
-	songName                                      string
+	format, songName                              string
 	numChannels, numInstruments                   int
 	numPatterns, sequenceLength, restartPos       int
 	defaultGVol, defaultSpeed, defaultTempo, gain int
@@ -84,6 +244,7 @@ type Module struct {
 	instruments                                   []*Instrument
 }
 
+/* Returns a blank module with 4 channels, one empty pattern and one silent instrument. */
 func NewModule() *Module {
 	return &Module{
 		songName:       "Blank",
@@ -111,13 +272,292 @@ func init() {
 	RegisterFormat("xm", IsXM, DecodeXM)
 	RegisterFormat("mod", IsMOD, DecodeMOD)
 	RegisterFormat("s3m", IsS3M, DecodeS3M)
+	RegisterFormat("it", IsIT, DecodeIT)
+	RegisterFormat("mtm", IsMTM, DecodeMTM)
+	RegisterFormat("669", Is669, Decode669)
+	RegisterFormat("stm", IsSTM, DecodeSTM)
+	/* Last, as the check is a heuristic. */
+	RegisterFormat("mod", IsSoundTracker, DecodeMOD)
+}
+
+/* Returns a DecodeError if the sequence contains nothing the player can play. */
+func (this *Module) checkSequence(format string) error {
+	if this.numChannels < 1 || len(this.defaultPanning) < this.numChannels {
+		return &DecodeError{format, 0, "invalid channel count"}
+	}
+	if this.sequenceLength > len(this.sequence) || len(this.patterns) < this.numPatterns {
+		return &DecodeError{format, 0, "inconsistent sequence"}
+	}
+	for idx := 0; idx < this.sequenceLength || idx < 1; idx++ {
+		if idx < len(this.sequence) && this.sequence[idx] < this.numPatterns {
+			return nil
+		}
+	}
+	return &DecodeError{format, 0, "no playable patterns in sequence"}
+}
+
+/* Cuts a fixed-length name field at the first NUL and removes trailing spaces. */
+func trimName(name string) string {
+	if idx := strings.IndexByte(name, 0); idx >= 0 {
+		name = name[:idx]
+	}
+	return strings.TrimRight(name, " ")
+}
+
+/* Returns the name of the format Decode found, such as "xm", or an empty string if the module was not loaded by Decode. */
+func (this *Module) Format() string {
+	return this.format
+}
+
+/* Returns the song name with padding removed. */
+func (this *Module) Name() string {
+	return trimName(this.songName)
+}
+
+func (this *Module) NumChannels() int {
+	return this.numChannels
+}
+
+/* Returns the pattern indexes in play order. Entries that are not valid pattern indexes are skipped. */
+func (this *Module) Sequence() []int {
+	return append([]int(nil), this.sequence[:this.sequenceLength]...)
+}
+
+/* Returns the sequence position playback continues from at the end of the song. */
+func (this *Module) RestartPos() int {
+	return this.restartPos
+}
+
+func (this *Module) Patterns() []*Pattern {
+	return append([]*Pattern(nil), this.patterns[:this.numPatterns]...)
+}
+
+/* Returns the instruments. Instrument n in pattern data is Instruments()[n-1]. */
+func (this *Module) Instruments() []*Instrument {
+	return append([]*Instrument(nil), this.instruments[1:this.numInstruments+1]...)
+}
+
+func (this *Module) DefaultSpeed() int {
+	return this.defaultSpeed
+}
+
+func (this *Module) DefaultTempo() int {
+	return this.defaultTempo
+}
+
+/* Returns the initial global volume (0 to 64). */
+func (this *Module) DefaultGlobalVolume() int {
+	return this.defaultGVol
+}
+
+/* Returns the initial panning (0 to 255) of each channel. */
+func (this *Module) DefaultPanning() []int {
+	return append([]int(nil), this.defaultPanning[:this.numChannels]...)
+}
+
+/* Returns the mixing gain (64 is unity). */
+func (this *Module) Gain() int {
+	return this.gain
+}
+
+func (this *Module) C2Rate() C2Rate {
+	return this.c2Rate
+}
+
+/* Returns true if the module uses linear rather than Amiga periods. */
+func (this *Module) LinearPeriods() bool {
+	return this.linearPeriods
+}
+
+func (this *Module) FastVolumeSlides() bool {
+	return this.fastVolSlides
+}
+
+func (this *Module) SetName(name string) {
+	this.songName = name
+}
+
+/* Sets the number of channels (1 to 128). Existing patterns are resized to match. An IBXM created before the change must not be used afterwards. */
+func (this *Module) SetNumChannels(numChannels int) error {
+	if numChannels < 1 || numChannels > 128 {
+		return ValueOutOfRange
+	}
+	for _, pattern := range this.patterns[:this.numPatterns] {
+		pattern.resize(numChannels)
+	}
+	panning := make([]int, numChannels)
+	for idx := range panning {
+		panning[idx] = 128
+	}
+	copy(panning, this.defaultPanning)
+	this.defaultPanning = panning
+	this.numChannels = numChannels
+	return nil
+}
+
+/* Sets the initial ticks per row (1 to 255). */
+func (this *Module) SetDefaultSpeed(speed int) error {
+	if speed < 1 || speed > 255 {
+		return ValueOutOfRange
+	}
+	this.defaultSpeed = speed
+	return nil
+}
+
+/* Sets the initial tempo in beats per minute (32 to 255). */
+func (this *Module) SetDefaultTempo(tempo int) error {
+	if tempo < 32 || tempo > 255 {
+		return ValueOutOfRange
+	}
+	this.defaultTempo = tempo
+	return nil
+}
+
+/* Sets the initial global volume (0 to 64). */
+func (this *Module) SetDefaultGlobalVolume(volume int) error {
+	if volume < 0 || volume > 64 {
+		return ValueOutOfRange
+	}
+	this.defaultGVol = volume
+	return nil
+}
+
+/* Sets the initial panning (0 to 255) of a channel. */
+func (this *Module) SetDefaultPanning(channel, panning int) error {
+	if channel < 0 || channel >= this.numChannels {
+		return IndexOutOfRange
+	}
+	if panning < 0 || panning > 255 {
+		return ValueOutOfRange
+	}
+	this.defaultPanning[channel] = panning
+	return nil
+}
+
+/* Sets the mixing gain (0 to 255, 64 is unity). */
+func (this *Module) SetGain(gain int) error {
+	if gain < 0 || gain > 255 {
+		return ValueOutOfRange
+	}
+	this.gain = gain
+	return nil
+}
+
+func (this *Module) SetC2Rate(c2Rate C2Rate) error {
+	if c2Rate <= 0 {
+		return ValueOutOfRange
+	}
+	this.c2Rate = c2Rate
+	return nil
+}
+
+func (this *Module) SetLinearPeriods(linear bool) {
+	this.linearPeriods = linear
+}
+
+func (this *Module) SetFastVolumeSlides(fast bool) {
+	this.fastVolSlides = fast
+}
+
+/* Appends a pattern and returns its index. */
+func (this *Module) AddPattern(pattern *Pattern) (int, error) {
+	if pattern == nil || pattern.numRows < 1 {
+		return 0, ValueOutOfRange
+	}
+	if pattern.NumChannels() != this.numChannels {
+		return 0, ChannelMismatch
+	}
+	this.patterns = append(this.patterns[:this.numPatterns], pattern)
+	this.numPatterns++
+	return this.numPatterns - 1, nil
+}
+
+/* Replaces the pattern at index. */
+func (this *Module) SetPattern(index int, pattern *Pattern) error {
+	if index < 0 || index >= this.numPatterns {
+		return IndexOutOfRange
+	}
+	if pattern == nil || pattern.numRows < 1 {
+		return ValueOutOfRange
+	}
+	if pattern.NumChannels() != this.numChannels {
+		return ChannelMismatch
+	}
+	this.patterns[index] = pattern
+	return nil
+}
+
+/* Replaces the sequence. Every entry must be the index of a pattern. */
+func (this *Module) SetSequence(sequence []int) error {
+	if len(sequence) < 1 {
+		return ValueOutOfRange
+	}
+	for _, patIdx := range sequence {
+		if patIdx < 0 || patIdx >= this.numPatterns {
+			return IndexOutOfRange
+		}
+	}
+	this.sequence = append([]int(nil), sequence...)
+	this.sequenceLength = len(sequence)
+	if this.restartPos >= this.sequenceLength {
+		this.restartPos = 0
+	}
+	return nil
+}
+
+/* Appends a pattern index to the sequence. */
+func (this *Module) AppendSequence(patIdx int) error {
+	if patIdx < 0 || patIdx >= this.numPatterns {
+		return IndexOutOfRange
+	}
+	this.sequence = append(this.sequence[:this.sequenceLength], patIdx)
+	this.sequenceLength++
+	return nil
+}
+
+/* Sets the sequence position playback continues from at the end of the song. */
+func (this *Module) SetRestartPos(pos int) error {
+	if pos < 0 || pos >= this.sequenceLength {
+		return IndexOutOfRange
+	}
+	this.restartPos = pos
+	return nil
+}
+
+/* Appends an instrument and returns its number as used in pattern data. Instruments must have samples and envelopes, so start from DefaultInstrument(). */
+func (this *Module) AddInstrument(instrument *Instrument) (int, error) {
+	if e := instrument.check(); e != nil {
+		return 0, e
+	}
+	if this.numInstruments >= 255 {
+		return 0, IndexOutOfRange
+	}
+	this.instruments = append(this.instruments[:this.numInstruments+1], instrument)
+	this.numInstruments++
+	return this.numInstruments, nil
+}
+
+/* Replaces the instrument with the specified number (1 to the number of instruments). The instrument is checked as by AddInstrument. */
+func (this *Module) SetInstrument(number int, instrument *Instrument) error {
+	if number < 1 || number > this.numInstruments {
+		return IndexOutOfRange
+	}
+	if e := instrument.check(); e != nil {
+		return e
+	}
+	this.instruments[number] = instrument
+	return nil
 }
 
 func Decode(r io.Reader) (*Module, error) {
 	reader := bufio.NewReader(r)
 	for _, f := range formats {
 		if f.check(reader) {
-			return f.decode(reader)
+			m, e := f.decode(reader)
+			if m != nil {
+				m.format = f.name
+			}
+			return m, e
 		}
 	}
 	return nil, UnsupportedFormat
@@ -136,11 +576,87 @@ func IsMOD(reader *bufio.Reader) bool {
 	if e != nil {
 		return false
 	}
+	return isMOD(header)
+}
+
+func isMOD(header []byte) bool {
+	if len(header) < 1084 {
+		return false
+	}
+	switch string(header[1080:1084]) {
+	case "FLT8", "OKTA", "CD81", "TDZ1", "TDZ2", "TDZ3":
+		return true
+	}
 	modFormat := binary.BigEndian.Uint16(header[1082:])
 	return modFormat == 0x4b2e || modFormat == 0x4b21 || modFormat == 0x5434 ||
 		modFormat == 0x484e || modFormat == 0x4348
 }
 
+/* Returns true if the start of a file looks like a 15-sample Soundtracker module, which has no signature. */
+func IsSoundTracker(reader *bufio.Reader) bool {
+	header, _ := reader.Peek(reader.Size())
+	return isSoundTracker(header)
+}
+
+/* Checks the header and as much of the pattern data as header contains, which must be at least one pattern. */
+func isSoundTracker(header []byte) bool {
+	if len(header) < 600+1024 {
+		return false
+	}
+	for _, c := range header[0:20] {
+		if c != 0 && c < 32 {
+			return false
+		}
+	}
+	sampleLength := 0
+	for instIdx := 1; instIdx <= 15; instIdx++ {
+		offset := instIdx*30 - 10
+		for _, c := range header[offset : offset+22] {
+			if c != 0 && c < 32 {
+				return false
+			}
+		}
+		if header[offset+24] > 15 || header[offset+25] > 64 {
+			return false
+		}
+		sampleLength += int(binary.BigEndian.Uint16(header[offset+22:])) * 2
+	}
+	if sampleLength == 0 || header[470] < 1 || header[470] > 128 {
+		return false
+	}
+	numPatterns := 0
+	for _, patIdx := range header[472:600] {
+		if patIdx > 63 {
+			return false
+		}
+		if int(patIdx) >= numPatterns {
+			numPatterns = int(patIdx) + 1
+		}
+	}
+	patternData := header[600 : 600+available(header, 600, numPatterns*256, 4)*4]
+	for idx := 0; idx < len(patternData); idx += 4 {
+		period := int(patternData[idx])<<8 | int(patternData[idx+1])
+		if period > 0xFFF || (period > 0 && (period < 113 || period > 1712)) {
+			return false
+		}
+	}
+	return true
+}
+
+/* Returns true if a 15-sample module stores loop starts in bytes, as Ultimate Soundtracker does, rather than in words as Master Soundtracker and Soundtracker 2 do. There is no signature, so this is assumed when a loop only fits its sample with the start in bytes. */
+func isUltimateSoundTracker(header []byte) bool {
+	for instIdx := 1; instIdx <= 15; instIdx++ {
+		offset := instIdx * 30
+		sampleLength := int(binary.BigEndian.Uint16(header[offset+12:])) * 2
+		loopStart := int(binary.BigEndian.Uint16(header[offset+16:]))
+		loopLength := int(binary.BigEndian.Uint16(header[offset+18:])) * 2
+		if loopLength > 2 && loopStart*2+loopLength > sampleLength && loopStart+loopLength <= sampleLength {
+			return true
+		}
+	}
+	return false
+}
+
 func IsS3M(reader *bufio.Reader) bool {
 	header, e := reader.Peek(48)
 	if e != nil {
@@ -155,6 +671,12 @@ func DecodeS3M(reader *bufio.Reader) (*Module, error) {
 	if e != nil {
 		return nil, e
 	}
+	if e := checkBounds("s3m", buff, 0, 96, "header"); e != nil {
+		return nil, e
+	}
+	if binary.LittleEndian.Uint32(buff[44:]) != 0x4d524353 {
+		return nil, &DecodeError{"s3m", 44, "not an S3M file"}
+	}
 	m := NewModule()
 
 	m.songName = string(buff[0:28])
@@ -165,9 +687,6 @@ func DecodeS3M(reader *bufio.Reader) (*Module, error) {
 	version := binary.LittleEndian.Uint16(buff[40:])
 	m.fastVolSlides = ((flags & 0x40) == 0x40) || version == 0x1300
 	signedSamples := binary.LittleEndian.Uint16(buff[42:]) == 1
-	if binary.LittleEndian.Uint32(buff[44:]) != 0x4d524353 {
-		errors.New("Not an S3M file!")
-	}
 	m.defaultGVol = int(buff[48])
 	m.defaultSpeed = int(buff[49])
 	m.defaultTempo = int(buff[50])
@@ -176,6 +695,7 @@ func DecodeS3M(reader *bufio.Reader) (*Module, error) {
 	stereoMode := (buff[51] & 0x80) == 0x80
 	defaultPan := (buff[53] & 0xFF) == 0xFC
 	channelMap := make([]int, 32)
+	m.numChannels = 0
 	for chanIdx := 0; chanIdx < 32; chanIdx++ {
 		channelMap[chanIdx] = -1
 		if buff[64+chanIdx] < 16 {
@@ -183,6 +703,9 @@ func DecodeS3M(reader *bufio.Reader) (*Module, error) {
 			m.numChannels++
 		}
 	}
+	if e := checkBounds("s3m", buff, 96, m.sequenceLength+(m.numInstruments+m.numPatterns)*2, "parapointers"); e != nil {
+		return nil, e
+	}
 	m.sequence = make([]int, m.sequenceLength)
 	for seqIdx := 0; seqIdx < m.sequenceLength; seqIdx++ {
 		m.sequence[seqIdx] = int(buff[96+seqIdx])
@@ -196,6 +719,9 @@ func DecodeS3M(reader *bufio.Reader) (*Module, error) {
 		sample := instrument.samples[0]
 		instOffset := int(binary.LittleEndian.Uint16(buff[moduleDataIdx:])) << 4
 		moduleDataIdx += 2
+		if e := checkBounds("s3m", buff, instOffset, 80, "instrument header"); e != nil {
+			return nil, e
+		}
 		instrument.name = string(buff[instOffset+48 : instOffset+48+28])
 		if buff[instOffset] != 1 {
 			continue
@@ -223,10 +749,21 @@ func DecodeS3M(reader *bufio.Reader) (*Module, error) {
 		_ = stereo
 		sixteenBit := (buff[instOffset+31] & 0x4) == 0x4
 		if packed {
-			errors.New("Packed samples not supported!")
+			return nil, &DecodeError{"s3m", instOffset + 30, "packed samples not supported"}
 		}
 		sample.c2Rate = C2Rate(binary.LittleEndian.Uint32(buff[instOffset+32:]))
-		sampleData := make([]int16, loopStart+loopLength)
+		if sample.c2Rate <= 0 {
+			sample.c2Rate = NTSC
+		}
+		bytesPerSample := 1
+		if sixteenBit {
+			bytesPerSample = 2
+		}
+		sampleData := make([]int16, available(buff, sampleOffset, loopStart+loopLength, bytesPerSample))
+		if len(sampleData) < loopStart+loopLength {
+			loopStart = len(sampleData)
+			loopLength = 0
+		}
 		if sixteenBit {
 			if signedSamples {
 				for idx, end := 0, len(sampleData); idx < end; idx++ {
@@ -259,15 +796,24 @@ func DecodeS3M(reader *bufio.Reader) (*Module, error) {
 	for patIdx := 0; patIdx < m.numPatterns; patIdx++ {
 		pattern := NewPattern(m.numChannels, 64)
 		m.patterns[patIdx] = pattern
-		inOffset := (binary.LittleEndian.Uint16(buff[moduleDataIdx:]) << 4) + 2
+		inOffset := (int(binary.LittleEndian.Uint16(buff[moduleDataIdx:])) << 4) + 2
 		rowIdx := 0
+		if inOffset == 2 { /* Empty pattern. */
+			rowIdx = 64
+		}
 		for rowIdx < 64 {
+			if e := checkBounds("s3m", buff, inOffset, 1, "pattern data"); e != nil {
+				return nil, e
+			}
 			token := buff[inOffset]
 			inOffset++
 			if token == 0 {
 				rowIdx++
 				continue
 			}
+			if e := checkBounds("s3m", buff, inOffset, s3mTokenLength(token), "pattern data"); e != nil {
+				return nil, e
+			}
 			noteKey := 0
 			noteIns := 0
 			if (token & 0x20) == 0x20 { /* Key + Instrument.*/
@@ -329,7 +875,7 @@ func DecodeS3M(reader *bufio.Reader) (*Module, error) {
 				panning = 3
 			}
 		}
-		if defaultPan {
+		if defaultPan && moduleDataIdx+chanIdx < len(buff) {
 			panFlags := buff[moduleDataIdx+chanIdx]
 			if (panFlags & 0x20) == 0x20 {
 				panning = int(panFlags & 0xF)
@@ -337,31 +883,98 @@ func DecodeS3M(reader *bufio.Reader) (*Module, error) {
 		}
 		m.defaultPanning[channelMap[chanIdx]] = panning * 17
 	}
+	if e := m.checkSequence("s3m"); e != nil {
+		return nil, e
+	}
 	return m, nil
 }
 
+/* Returns the number of bytes following a packed S3M pattern token. */
+func s3mTokenLength(token byte) int {
+	length := 0
+	if (token & 0x20) == 0x20 {
+		length += 2
+	}
+	if (token & 0x40) == 0x40 {
+		length++
+	}
+	if (token & 0x80) == 0x80 {
+		length += 2
+	}
+	return length
+}
+
+/* Returns the key nearest to an Amiga period, or 0 if the period is too small. */
+func periodToKey(period int) int {
+	period *= 4
+	if period <= 112 {
+		return 0
+	}
+	key, oct := 0, 0
+	for period < 14510 {
+		period *= 2
+		oct++
+	}
+	for key < 12 {
+		d1 := keyToPeriod[key] - period
+		d2 := period - keyToPeriod[key+1]
+		if d2 >= 0 {
+			if d2 < d1 {
+				key++
+			}
+			break
+		}
+		key++
+	}
+	return oct*12 + key
+}
+
+/* Converts a MOD effect to the numbering stored in patterns. Slides with a zero parameter are removed, except that 5 and 6 still continue the tone portamento or vibrato as 3 and 4. */
+func convertMODEffect(effect, param byte) (byte, byte) {
+	if param == 0 && (effect < 3 || effect == 0xA) {
+		effect = 0
+	}
+	if param == 0 && (effect == 5 || effect == 6) {
+		effect -= 2
+	}
+	return effect, param
+}
+
 func DecodeMOD(reader *bufio.Reader) (*Module, error) {
 	buff, e := ioutil.ReadAll(reader)
 	if e != nil {
 		return nil, e
 	}
+	numInstruments, seqOffset, moduleDataIdx := 31, 950, 1084
+	if !isMOD(buff) && isSoundTracker(buff) {
+		numInstruments, seqOffset, moduleDataIdx = 15, 470, 600
+	}
+	if e := checkBounds("mod", buff, 0, moduleDataIdx, "header"); e != nil {
+		return nil, e
+	}
 	m := NewModule()
 
 	m.songName = string(buff[0:20])
-	m.sequenceLength = int(buff[950] & 0x7F)
-	m.restartPos = int(buff[951] & 0x7F)
-	if m.restartPos >= m.sequenceLength {
+	m.sequenceLength = int(buff[seqOffset] & 0x7F)
+	m.restartPos = int(buff[seqOffset+1] & 0x7F)
+	if m.restartPos >= m.sequenceLength || numInstruments == 15 {
 		m.restartPos = 0
 	}
 	m.sequence = make([]int, 128)
 	for seqIdx := 0; seqIdx < 128; seqIdx++ {
-		patIdx := int(buff[952+seqIdx] & 0x7F)
+		patIdx := int(buff[seqOffset+2+seqIdx] & 0x7F)
 		m.sequence[seqIdx] = patIdx
 		if patIdx >= m.numPatterns {
 			m.numPatterns = patIdx + 1
 		}
 	}
-	switch binary.BigEndian.Uint16(buff[1082:]) {
+	modFormat := 0
+	if numInstruments == 31 {
+		modFormat = int(binary.BigEndian.Uint16(buff[1082:]))
+	}
+	switch modFormat {
+	case 0: /* 15-sample Soundtracker. */
+		fallthrough
 	case 0x4b2e: /* M.K. */
 		fallthrough
 	case 0x4b21: /* M!K! */
@@ -382,12 +995,47 @@ func DecodeMOD(reader *bufio.Reader) (*Module, error) {
 		m.c2Rate = NTSC
 		m.gain = 32
 		break
+	case 0x5438: /* FLT8 */
+		fallthrough
+	case 0x5441: /* OKTA */
+		fallthrough
+	case 0x3831: /* CD81 */
+		m.numChannels = 8
+		m.c2Rate = PAL
+		m.gain = 32
+		break
+	case 0x5a31, 0x5a32, 0x5a33: /* TDZx */
+		m.numChannels = int(buff[1083]) - 48
+		m.c2Rate = NTSC
+		m.gain = 64
+		break
 	default:
-		panic("MOD Format not recognised!")
+		return nil, &DecodeError{"mod", 1080, "format not recognised"}
+	}
+	flt8 := modFormat == 0x5438
+	if flt8 {
+		/* Startrekker stores each pattern as two 4-channel patterns, and the sequence refers to the first of each pair. */
+		m.numPatterns = 0
+		for seqIdx := range m.sequence {
+			m.sequence[seqIdx] >>= 1
+			if m.sequence[seqIdx] >= m.numPatterns {
+				m.numPatterns = m.sequence[seqIdx] + 1
+			}
+		}
+	}
+	if m.numChannels < 1 || m.numChannels > 99 {
+		return nil, &DecodeError{"mod", 1080, "invalid channel count"}
 	}
 	m.defaultGVol = 64
 	m.defaultSpeed = 6
 	m.defaultTempo = 125
+	/* Ultimate Soundtracker stores a timer value in place of the restart position. */
+	if timer := int(buff[seqOffset+1]); numInstruments == 15 && timer != 0 && timer != 0x78 && timer < 240 {
+		tempo := (709379*125/50 + (240-timer)*61) / ((240 - timer) * 122)
+		if tempo >= 32 && tempo <= 255 {
+			m.defaultTempo = tempo
+		}
+	}
 	m.defaultPanning = make([]int, m.numChannels)
 	for idx := 0; idx < m.numChannels; idx++ {
 		m.defaultPanning[idx] = 51
@@ -395,55 +1043,37 @@ func DecodeMOD(reader *bufio.Reader) (*Module, error) {
 			m.defaultPanning[idx] = 204
 		}
 	}
-	moduleDataIdx := 1084
+	if e := checkBounds("mod", buff, moduleDataIdx, m.numPatterns*m.numChannels*256, "pattern data"); e != nil {
+		return nil, e
+	}
 	m.patterns = make([]*Pattern, m.numPatterns)
 
 	for patIdx := 0; patIdx < m.numPatterns; patIdx++ {
 		pattern := NewPattern(m.numChannels, 64)
 		m.patterns[patIdx] = pattern
 		for patDataIdx := 0; patDataIdx < len(pattern.data); patDataIdx += 5 {
-			period := int(buff[moduleDataIdx]&0xF) << 8
-			period = (period | int(buff[moduleDataIdx+1])) * 4
-			if period > 112 {
-				key, oct := 0, 0
-				for period < 14510 {
-					period *= 2
-					oct++
-				}
-				for key < 12 {
-					d1 := keyToPeriod[key] - period
-					d2 := period - keyToPeriod[key+1]
-					if d2 >= 0 {
-						if d2 < d1 {
-							key++
-						}
-						break
-					}
-					key++
-				}
-				pattern.data[patDataIdx] = (byte)(oct*12 + key)
+			noteIdx := moduleDataIdx + patDataIdx/5*4
+			if flt8 {
+				row, chanIdx := patDataIdx/40, patDataIdx/5%8
+				noteIdx = moduleDataIdx + (chanIdx>>2)*1024 + row*16 + (chanIdx&3)*4
 			}
-			ins := int(buff[moduleDataIdx+2]&0xF0) >> 4
-			ins = ins | int(buff[moduleDataIdx]&0x10)
+			period := int(buff[noteIdx]&0xF) << 8
+			pattern.data[patDataIdx] = (byte)(periodToKey(period | int(buff[noteIdx+1])))
+			ins := int(buff[noteIdx+2]&0xF0) >> 4
+			ins = ins | int(buff[noteIdx]&0x10)
 			pattern.data[patDataIdx+1] = (byte)(ins)
-			effect := buff[moduleDataIdx+2] & 0x0F
-			param := buff[moduleDataIdx+3] & 0xFF
-			if param == 0 && (effect < 3 || effect == 0xA) {
-				effect = 0
-			}
-			if param == 0 && (effect == 5 || effect == 6) {
-				effect -= 2
-			}
+			effect, param := convertMODEffect(buff[noteIdx+2]&0x0F, buff[noteIdx+3])
 			if effect == 8 && m.numChannels == 4 {
 				effect = 0
 				param = 0
 			}
 			pattern.data[patDataIdx+3] = (byte)(effect)
 			pattern.data[patDataIdx+4] = (byte)(param)
-			moduleDataIdx += 4
 		}
+		moduleDataIdx += len(pattern.data) / 5 * 4
 	}
-	m.numInstruments = 31
+	m.numInstruments = numInstruments
+	byteLoops := numInstruments == 15 && isUltimateSoundTracker(buff)
 	m.instruments = make([]*Instrument, m.numInstruments+1)
 	m.instruments[0] = DefaultInstrument()
 	for instIdx := 1; instIdx <= m.numInstruments; instIdx++ {
@@ -464,7 +1094,10 @@ func DecodeMOD(reader *bufio.Reader) (*Module, error) {
 		}
 		sample.panning = -1
 		sample.c2Rate = m.c2Rate
-		loopStart := int(binary.BigEndian.Uint16(buff[instIdx*30+16:])) * 2
+		loopStart := int(binary.BigEndian.Uint16(buff[instIdx*30+16:]))
+		if !byteLoops {
+			loopStart *= 2
+		}
 		loopLength := int(binary.BigEndian.Uint16(buff[instIdx*30+18:])) * 2
 		sampleData := make([]int16, sampleLength)
 		if moduleDataIdx+sampleLength > len(buff) {
@@ -483,6 +1116,9 @@ func DecodeMOD(reader *bufio.Reader) (*Module, error) {
 		}
 		sample.setSampleData(sampleData, loopStart, loopLength, false)
 	}
+	if e := m.checkSequence("mod"); e != nil {
+		return nil, e
+	}
 	return m, nil
 }
 
@@ -491,15 +1127,18 @@ func DecodeXM(reader *bufio.Reader) (*Module, error) {
 	if e != nil {
 		return nil, e
 	}
+	if e := checkBounds("xm", buff, 0, 80, "header"); e != nil {
+		return nil, e
+	}
 	if buff[58] != 0x04 && buff[59] != 0x01 {
-		return nil, errors.New("XM format version must be 0x0104!")
+		return nil, &DecodeError{"xm", 58, "XM format version must be 0x0104"}
 	}
 
 	m := NewModule()
 
 	m.songName = string(buff[17:37])
 	deltaEnv := bytes.Equal(buff[38:38+len(deltaEnvHeader)], deltaEnvHeader)
-	dataOffset := 60 + binary.LittleEndian.Uint32(buff[60:])
+	dataOffset := 60 + int(binary.LittleEndian.Uint32(buff[60:]))
 	m.sequenceLength = int(binary.LittleEndian.Uint16(buff[64:]))
 	m.restartPos = int(binary.LittleEndian.Uint16(buff[66:]))
 	m.numChannels = int(binary.LittleEndian.Uint16(buff[68:]))
@@ -510,6 +1149,18 @@ func DecodeXM(reader *bufio.Reader) (*Module, error) {
 	m.defaultSpeed = int(binary.LittleEndian.Uint16(buff[76:]))
 	m.defaultTempo = int(binary.LittleEndian.Uint16(buff[78:]))
 	m.c2Rate = NTSC
+	if m.restartPos >= m.sequenceLength {
+		m.restartPos = 0
+	}
+	if m.numChannels < 1 || m.numChannels > 128 {
+		return nil, &DecodeError{"xm", 68, "invalid channel count"}
+	}
+	if m.numPatterns > 256 || m.numInstruments > 255 {
+		return nil, &DecodeError{"xm", 70, "too many patterns or instruments"}
+	}
+	if e := checkBounds("xm", buff, 80, m.sequenceLength, "sequence"); e != nil {
+		return nil, e
+	}
 
 	sequenceLength := m.sequenceLength
 	numChannels := m.numChannels
@@ -537,27 +1188,45 @@ func DecodeXM(reader *bufio.Reader) (*Module, error) {
 	}
 
 	for patIdx := 0; patIdx < numPatterns; patIdx++ {
+		if e := checkBounds("xm", buff, dataOffset, 9, "pattern header"); e != nil {
+			return nil, e
+		}
 		if buff[dataOffset+4] != 0 {
-			return nil, errors.New("Unknown pattern packing type!")
+			return nil, &DecodeError{"xm", dataOffset + 4, "unknown pattern packing type"}
 		}
 		numRows := int(binary.LittleEndian.Uint16(buff[dataOffset+5:]))
+		if numRows < 1 {
+			numRows = 64
+		}
+		if numRows > 256 {
+			return nil, &DecodeError{"xm", dataOffset + 5, "too many rows in pattern"}
+		}
 		numNotes := numRows * numChannels
 
 		pattern := NewPattern(numChannels, numRows)
 		patterns[patIdx] = pattern
 
-		patternDataLength := uint32(binary.LittleEndian.Uint16(buff[dataOffset+7:]))
-		dataOffset += binary.LittleEndian.Uint32(buff[dataOffset:])
+		patternDataLength := int(binary.LittleEndian.Uint16(buff[dataOffset+7:]))
+		dataOffset += int(binary.LittleEndian.Uint32(buff[dataOffset:]))
 		nextOffset := dataOffset + patternDataLength
+		if e := checkBounds("xm", buff, dataOffset, patternDataLength, "pattern data"); e != nil {
+			return nil, e
+		}
 		if patternDataLength > 0 {
 			patternDataOffset := 0
 			for note := 0; note < numNotes; note++ {
+				if dataOffset >= nextOffset {
+					return nil, &DecodeError{"xm", dataOffset, "truncated pattern data"}
+				}
 				flags := buff[dataOffset]
 				if (flags & 0x80) == 0 {
 					flags = 0x1F
 				} else {
 					dataOffset++
 				}
+				if dataOffset+bits.OnesCount8(flags&0x1F) > nextOffset {
+					return nil, &DecodeError{"xm", dataOffset, "truncated pattern data"}
+				}
 				if (flags & 0x01) > 0 {
 					pattern.data[patternDataOffset] = buff[dataOffset]
 					dataOffset++
@@ -600,16 +1269,26 @@ func DecodeXM(reader *bufio.Reader) (*Module, error) {
 
 	instruments[0] = DefaultInstrument()
 	for insIdx := 1; insIdx <= numInstruments; insIdx++ {
-		instrument := &Instrument{}
+		if e := checkBounds("xm", buff, dataOffset, 29, "instrument header"); e != nil {
+			return nil, e
+		}
+		instrument := DefaultInstrument()
 		instruments[insIdx] = instrument
 		instrument.name = string(buff[dataOffset+4 : dataOffset+4+22])
 		numSamples := int(binary.LittleEndian.Uint16(buff[dataOffset+27:]))
-		instrument.numSamples = numSamples
 
 		if numSamples > 0 {
+			if e := checkBounds("xm", buff, dataOffset, 241, "instrument header"); e != nil {
+				return nil, e
+			}
+			instrument.numSamples = numSamples
 			instrument.samples = make([]*Sample, numSamples)
-			for keyIdx := uint32(0); keyIdx < 96; keyIdx++ {
-				instrument.keyToSample[keyIdx+1] = int(buff[dataOffset+33+keyIdx])
+			for keyIdx := 0; keyIdx < 96; keyIdx++ {
+				samIdx := int(buff[dataOffset+33+keyIdx])
+				if samIdx >= numSamples {
+					samIdx = 0
+				}
+				instrument.keyToSample[keyIdx+1] = samIdx
 			}
 			volEnv := &Envelope{}
 			instrument.volumeEnvelope = volEnv
@@ -617,7 +1296,7 @@ func DecodeXM(reader *bufio.Reader) (*Module, error) {
 			volEnv.pointsAmpl = make([]int, 12)
 
 			pointTick := 0
-			for point := uint32(0); point < 12; point++ {
+			for point := 0; point < 12; point++ {
 				pointOffset := dataOffset + 129 + (point * 4)
 				pt := int(binary.LittleEndian.Uint16(buff[pointOffset:]))
 				volEnv.pointsTick[point] = pt
@@ -634,7 +1313,7 @@ func DecodeXM(reader *bufio.Reader) (*Module, error) {
 			panEnv.pointsTick = make([]int, 12)
 			panEnv.pointsAmpl = make([]int, 12)
 			pointTick = 0
-			for point := uint32(0); point < 12; point++ {
+			for point := 0; point < 12; point++ {
 				pointOffset := dataOffset + 177 + (point * 4)
 				pt := int(binary.LittleEndian.Uint16(buff[pointOffset:]))
 				panEnv.pointsTick[point] = pt
@@ -654,18 +1333,20 @@ func DecodeXM(reader *bufio.Reader) (*Module, error) {
 			if panEnv.numPoints > 12 {
 				panEnv.numPoints = 0
 			}
-			volEnv.sustainTick = volEnv.pointsTick[buff[dataOffset+227]]
-			volEnv.loopStartTick = volEnv.pointsTick[buff[dataOffset+228]]
-			volEnv.loopEndTick = volEnv.pointsTick[buff[dataOffset+229]]
-			panEnv.sustainTick = panEnv.pointsTick[buff[dataOffset+230]]
-			panEnv.loopStartTick = panEnv.pointsTick[buff[dataOffset+231]]
-			panEnv.loopEndTick = panEnv.pointsTick[buff[dataOffset+232]]
+			volEnv.sustainTick = volEnv.pointTick(int(buff[dataOffset+227]))
+			volEnv.loopStartTick = volEnv.pointTick(int(buff[dataOffset+228]))
+			volEnv.loopEndTick = volEnv.pointTick(int(buff[dataOffset+229]))
+			panEnv.sustainTick = panEnv.pointTick(int(buff[dataOffset+230]))
+			panEnv.loopStartTick = panEnv.pointTick(int(buff[dataOffset+231]))
+			panEnv.loopEndTick = panEnv.pointTick(int(buff[dataOffset+232]))
 			volEnv.enabled = volEnv.numPoints > 0 && (buff[dataOffset+233]&0x1) > 0
 			volEnv.sustain = (buff[dataOffset+233] & 0x2) > 0
 			volEnv.looped = (buff[dataOffset+233] & 0x4) > 0
 			panEnv.enabled = panEnv.numPoints > 0 && (buff[dataOffset+234]&0x1) > 0
 			panEnv.sustain = (buff[dataOffset+234] & 0x2) > 0
 			panEnv.looped = (buff[dataOffset+234] & 0x4) > 0
+			volEnv.checkPoints()
+			panEnv.checkPoints()
 			instrument.vibratoType = int(buff[dataOffset+235])
 			instrument.vibratoSweep = int(buff[dataOffset+236])
 			instrument.vibratoDepth = int(buff[dataOffset+237])
@@ -673,17 +1354,20 @@ func DecodeXM(reader *bufio.Reader) (*Module, error) {
 			instrument.volumeFadeOut = int(binary.LittleEndian.Uint16((buff[dataOffset+239:])))
 		}
 
-		dataOffset += binary.LittleEndian.Uint32(buff[dataOffset:])
+		dataOffset += int(binary.LittleEndian.Uint32(buff[dataOffset:]))
 
 		sampleHeaderOffset := dataOffset
-		dataOffset += uint32(numSamples) * 40
+		dataOffset += numSamples * 40
+		if e := checkBounds("xm", buff, sampleHeaderOffset, numSamples*40, "sample headers"); e != nil {
+			return nil, e
+		}
 		for samIdx := 0; samIdx < numSamples; samIdx++ {
 			sample := &Sample{}
 			instrument.samples[samIdx] = sample
 
-			sampleDataBytes := binary.LittleEndian.Uint32(buff[sampleHeaderOffset:])
-			sampleLoopStart := binary.LittleEndian.Uint32(buff[sampleHeaderOffset+4:])
-			sampleLoopLength := binary.LittleEndian.Uint32(buff[sampleHeaderOffset+8:])
+			sampleDataBytes := int(binary.LittleEndian.Uint32(buff[sampleHeaderOffset:]))
+			sampleLoopStart := int(binary.LittleEndian.Uint32(buff[sampleHeaderOffset+4:]))
+			sampleLoopLength := int(binary.LittleEndian.Uint32(buff[sampleHeaderOffset+8:]))
 
 			sample.volume = int(int8(buff[sampleHeaderOffset+12]))
 			sample.fineTune = int(int8(buff[sampleHeaderOffset+13]))
@@ -697,9 +1381,11 @@ func DecodeXM(reader *bufio.Reader) (*Module, error) {
 			sampleHeaderOffset += 40
 			sampleDataLength := sampleDataBytes
 			if sixteenBit {
-				sampleDataLength /= 2
+				sampleDataLength = available(buff, dataOffset, sampleDataLength/2, 2)
 				sampleLoopStart /= 2
 				sampleLoopLength /= 2
+			} else {
+				sampleDataLength = available(buff, dataOffset, sampleDataLength, 1)
 			}
 			if !looped || (sampleLoopStart+sampleLoopLength) > sampleDataLength {
 				sampleLoopStart = sampleDataLength
@@ -708,7 +1394,7 @@ func DecodeXM(reader *bufio.Reader) (*Module, error) {
 			sampleData := make([]int16, sampleDataLength)
 			if sixteenBit {
 				ampl := uint16(0)
-				for outIdx := uint32(0); outIdx < sampleDataLength; outIdx++ {
+				for outIdx := 0; outIdx < sampleDataLength; outIdx++ {
 					inIdx := dataOffset + outIdx*2
 					ampl += uint16(buff[inIdx])
 					ampl += uint16(buff[inIdx+1]) << 8
@@ -716,16 +1402,19 @@ func DecodeXM(reader *bufio.Reader) (*Module, error) {
 				}
 			} else {
 				ampl := byte(0)
-				for outIdx := uint32(0); outIdx < sampleDataLength; outIdx++ {
+				for outIdx := 0; outIdx < sampleDataLength; outIdx++ {
 					ampl += buff[dataOffset+outIdx]
 					sampleData[outIdx] = int16(uint16(ampl) << 8)
 				}
 			}
 
-			sample.setSampleData(sampleData, int(sampleLoopStart), int(sampleLoopLength), pingPong)
+			sample.setSampleData(sampleData, sampleLoopStart, sampleLoopLength, pingPong)
 			dataOffset += sampleDataBytes
 		}
 	}
 
+	if e := m.checkSequence("xm"); e != nil {
+		return nil, e
+	}
 	return m, nil
 }
@@ -0,0 +1,289 @@
+package ibxmgo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+/* Returns a 15-sample Soundtracker module with one pattern played twice and two samples. The loop start of the first sample is stored as loopStart. */
+func soundTrackerModule(timer byte, loopStart uint16) []byte {
+	buff := make([]byte, 600+1024)
+	copy(buff, "soundtracker")
+	for instIdx := 1; instIdx <= 15; instIdx++ {
+		copy(buff[instIdx*30-10:], "sample")
+	}
+	/* Sample 1: 200 bytes with a 150 byte loop. */
+	binary.BigEndian.PutUint16(buff[1*30+12:], 100)
+	buff[1*30+15] = 64
+	binary.BigEndian.PutUint16(buff[1*30+16:], loopStart)
+	binary.BigEndian.PutUint16(buff[1*30+18:], 75)
+	/* Sample 2: 20 bytes, not looped. */
+	binary.BigEndian.PutUint16(buff[2*30+12:], 10)
+	buff[2*30+15] = 32
+	binary.BigEndian.PutUint16(buff[2*30+18:], 1)
+	buff[470], buff[471] = 2, timer
+	buff[472], buff[473] = 0, 0
+	/* Row 0 channel 0: period 428, sample 1, set volume. */
+	copy(buff[600:], []byte{0x01, 0xAC, 0x1C, 0x20})
+	/* Row 1 channel 3: period 214, sample 2, volume slide. */
+	copy(buff[600+16+12:], []byte{0x00, 0xD6, 0x2A, 0x01})
+	for idx := 0; idx < 220; idx++ {
+		buff = append(buff, byte(idx*7))
+	}
+	return buff
+}
+
+func TestDecodeSoundTracker(t *testing.T) {
+	tests := []struct {
+		timer     byte
+		wantTempo int
+	}{
+		{0, 125},
+		{0x78, 125},
+		{0xA0, 182},
+		{0xF0, 125},
+	}
+	for _, test := range tests {
+		m, e := Decode(bytes.NewReader(soundTrackerModule(test.timer, 50)))
+		if e != nil {
+			t.Fatalf("timer %d: %v", test.timer, e)
+		}
+		if m.Format() != "mod" || m.numInstruments != 15 || m.NumChannels() != 4 {
+			t.Errorf("timer %d: format %q with %d instruments and %d channels",
+				test.timer, m.Format(), m.numInstruments, m.NumChannels())
+		}
+		if m.DefaultTempo() != test.wantTempo || m.DefaultSpeed() != 6 {
+			t.Errorf("timer %d: speed %d tempo %d, want 6 %d", test.timer, m.DefaultSpeed(), m.DefaultTempo(), test.wantTempo)
+		}
+		if m.RestartPos() != 0 {
+			t.Errorf("timer %d: restart position %d, want 0", test.timer, m.RestartPos())
+		}
+	}
+
+	m, e := Decode(bytes.NewReader(soundTrackerModule(0, 50)))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if sequence := m.Sequence(); !reflect.DeepEqual(sequence, []int{0, 0}) {
+		t.Errorf("sequence %v, want [0 0]", sequence)
+	}
+	notes := []struct {
+		row, channel int
+		want         Note
+	}{
+		{0, 0, Note{Key: 49, Instrument: 1, Effect: 0xC, Param: 0x20}},
+		{1, 3, Note{Key: 61, Instrument: 2, Effect: 0xA, Param: 0x01}},
+		{0, 1, Note{}},
+	}
+	for _, test := range notes {
+		if note := m.patterns[0].Note(test.row, test.channel); note != test.want {
+			t.Errorf("row %d channel %d: %+v, want %+v", test.row, test.channel, note, test.want)
+		}
+	}
+	samples := []struct {
+		length, loopStart, loopLength, volume int
+	}{
+		{200, 50, 150, 64},
+		{20, 0, 0, 32},
+	}
+	offset := 0
+	for idx, test := range samples {
+		sample := m.instruments[idx+1].samples[0]
+		data := sample.Data()
+		if len(data) != test.length {
+			t.Errorf("sample %d: length %d, want %d", idx+1, len(data), test.length)
+		} else if data[1] != int16(int8((offset+1)*7))<<8 {
+			t.Errorf("sample %d: data %d", idx+1, data[1])
+		}
+		offset += test.length
+		if start, length := sample.Loop(); start != test.loopStart || length != test.loopLength {
+			t.Errorf("sample %d: loop %d+%d, want %d+%d", idx+1, start, length, test.loopStart, test.loopLength)
+		}
+		if sample.Volume() != test.volume {
+			t.Errorf("sample %d: volume %d, want %d", idx+1, sample.Volume(), test.volume)
+		}
+	}
+}
+
+func TestDecodeSoundTrackerLoopStart(t *testing.T) {
+	tests := []struct {
+		name          string
+		loopStart     uint16
+		wantLoopStart int
+	}{
+		/* The loop only fits in 200 bytes with the start in bytes. */
+		{"Ultimate Soundtracker", 50, 50},
+		/* 25 words and 50 bytes both fit, so the start is read in words. */
+		{"Master Soundtracker", 25, 50},
+		{"Soundtracker 2", 0, 0},
+	}
+	for _, test := range tests {
+		m, e := Decode(bytes.NewReader(soundTrackerModule(0x78, test.loopStart)))
+		if e != nil {
+			t.Fatalf("%s: %v", test.name, e)
+		}
+		if start, length := m.instruments[1].samples[0].Loop(); start != test.wantLoopStart || length != 150 {
+			t.Errorf("%s: loop %d+%d, want %d+150", test.name, start, length, test.wantLoopStart)
+		}
+	}
+}
+
+/* Returns a 31-sample module with the given signature and no samples. Row 5 of each pattern has a note in every channel, with instrument 8*pattern+channel+1. */
+func modVariantModule(tag string, numChannels int, sequence []int) []byte {
+	flt8 := tag == "FLT8"
+	buff := make([]byte, 1084)
+	copy(buff, "variant")
+	buff[950] = byte(len(sequence))
+	numPatterns := 0
+	for seqIdx, patIdx := range sequence {
+		buff[952+seqIdx] = byte(patIdx)
+		if flt8 {
+			buff[952+seqIdx] = byte(patIdx * 2)
+		}
+		if patIdx >= numPatterns {
+			numPatterns = patIdx + 1
+		}
+	}
+	copy(buff[1080:], tag)
+	buff = append(buff, make([]byte, numPatterns*numChannels*256)...)
+	for patIdx := 0; patIdx < numPatterns; patIdx++ {
+		for chanIdx := 0; chanIdx < numChannels; chanIdx++ {
+			offset := 1084 + patIdx*numChannels*256 + 5*numChannels*4 + chanIdx*4
+			if flt8 {
+				offset = 1084 + (patIdx*2+chanIdx/4)*1024 + 5*16 + chanIdx%4*4
+			}
+			ins := patIdx*8 + chanIdx + 1
+			copy(buff[offset:], []byte{byte(ins&0x10) | 0x01, 0xAC, byte(ins&0xF) << 4, 0})
+		}
+	}
+	return buff
+}
+
+func TestDecodeMODVariants(t *testing.T) {
+	tests := []struct {
+		tag             string
+		numChannels     int
+		wantChannels    int
+		wantC2Rate      C2Rate
+		wantGain        int
+		sequence        []int
+		wantNumPatterns int
+	}{
+		{"FLT8", 8, 8, PAL, 32, []int{1, 0, 1}, 2},
+		{"OKTA", 8, 8, PAL, 32, []int{0, 1}, 2},
+		{"CD81", 8, 8, PAL, 32, []int{1, 0}, 2},
+		{"TDZ1", 1, 1, NTSC, 64, []int{0}, 1},
+		{"TDZ3", 3, 3, NTSC, 64, []int{0, 1}, 2},
+		{"M.K.", 4, 4, PAL, 64, []int{1, 0}, 2},
+	}
+	for _, test := range tests {
+		m, e := Decode(bytes.NewReader(modVariantModule(test.tag, test.numChannels, test.sequence)))
+		if e != nil {
+			t.Errorf("%s: %v", test.tag, e)
+			continue
+		}
+		if m.NumChannels() != test.wantChannels || m.C2Rate() != test.wantC2Rate || m.Gain() != test.wantGain {
+			t.Errorf("%s: %d channels, C2 rate %d, gain %d", test.tag, m.NumChannels(), m.C2Rate(), m.Gain())
+		}
+		if sequence := m.Sequence(); !reflect.DeepEqual(sequence, test.sequence) {
+			t.Errorf("%s: sequence %v, want %v", test.tag, sequence, test.sequence)
+		}
+		if m.numPatterns != test.wantNumPatterns {
+			t.Errorf("%s: %d patterns, want %d", test.tag, m.numPatterns, test.wantNumPatterns)
+			continue
+		}
+		for patIdx, pattern := range m.Patterns() {
+			for chanIdx := 0; chanIdx < test.wantChannels; chanIdx++ {
+				want := Note{Key: 49, Instrument: patIdx*8 + chanIdx + 1}
+				if note := pattern.Note(5, chanIdx); note != want {
+					t.Errorf("%s: pattern %d channel %d: %+v, want %+v", test.tag, patIdx, chanIdx, note, want)
+				}
+				if note := pattern.Note(4, chanIdx); note != (Note{}) {
+					t.Errorf("%s: pattern %d channel %d row 4: %+v", test.tag, patIdx, chanIdx, note)
+				}
+			}
+		}
+	}
+}
+
+func TestInstrumentValidation(t *testing.T) {
+	if e := (&Envelope{}).SetEnabled(true); e != ValueOutOfRange {
+		t.Errorf("enabling an envelope without points: %v", e)
+	}
+	envelope := &Envelope{}
+	if e := envelope.SetPoints([]EnvelopePoint{{0, 64}, {10, 0}}); e != nil {
+		t.Fatal(e)
+	}
+	if e := envelope.SetEnabled(true); e != nil {
+		t.Errorf("enabling an envelope with points: %v", e)
+	}
+
+	m := NewModule()
+	noSamples := DefaultInstrument()
+	noSamples.numSamples, noSamples.samples = 0, nil
+	noEnvelope := DefaultInstrument()
+	noEnvelope.panningEnvelope = nil
+	tests := []struct {
+		name       string
+		instrument *Instrument
+	}{
+		{"nil", nil},
+		{"zero", &Instrument{}},
+		{"no samples", noSamples},
+		{"no envelope", noEnvelope},
+	}
+	for _, test := range tests {
+		if _, e := m.AddInstrument(test.instrument); e != ValueOutOfRange {
+			t.Errorf("AddInstrument(%s): %v", test.name, e)
+		}
+		if e := m.SetInstrument(1, test.instrument); e != ValueOutOfRange {
+			t.Errorf("SetInstrument(%s): %v", test.name, e)
+		}
+	}
+	if _, e := m.AddInstrument(DefaultInstrument()); e != nil {
+		t.Errorf("AddInstrument(DefaultInstrument()): %v", e)
+	}
+}
+
+func TestDecodeS3MChannels(t *testing.T) {
+	buff := make([]byte, 96)
+	copy(buff, "channels")
+	buff[28], buff[29] = 0x1A, 16
+	binary.LittleEndian.PutUint16(buff[32:], 2)
+	binary.LittleEndian.PutUint16(buff[36:], 1)
+	binary.LittleEndian.PutUint16(buff[40:], 0x1320)
+	binary.LittleEndian.PutUint16(buff[42:], 2)
+	copy(buff[44:], "SCRM")
+	buff[48], buff[49], buff[50], buff[51] = 64, 6, 125, 0xB0
+	/* Only the first and sixth channels are enabled, as L1 and R2. */
+	for chanIdx := 0; chanIdx < 32; chanIdx++ {
+		buff[64+chanIdx] = 0xFF
+	}
+	buff[64], buff[69] = 0, 9
+	buff = append(buff, 0, 0xFF)
+	buff = binary.LittleEndian.AppendUint16(buff, 7)
+	for len(buff) < 7*16 {
+		buff = append(buff, 0)
+	}
+	/* Row 0 has a note in the sixth channel, the other rows are empty. */
+	pattern := []byte{0x20 | 5, 0x40, 1, 0}
+	pattern = append(pattern, make([]byte, 63)...)
+	buff = binary.LittleEndian.AppendUint16(buff, uint16(len(pattern)+2))
+	buff = append(buff, pattern...)
+
+	m, e := Decode(bytes.NewReader(buff))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if m.Format() != "s3m" || m.NumChannels() != 2 {
+		t.Fatalf("format %q with %d channels, want s3m with 2", m.Format(), m.NumChannels())
+	}
+	if panning := m.DefaultPanning(); !reflect.DeepEqual(panning, []int{3 * 17, 12 * 17}) {
+		t.Errorf("panning %v", panning)
+	}
+	if note := m.patterns[0].Note(0, 1); note != (Note{Key: 49, Instrument: 1}) {
+		t.Errorf("note %+v, want key 49 instrument 1 in the second channel", note)
+	}
+}
@@ -0,0 +1,149 @@
+package ibxmgo
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io/ioutil"
+)
+
+func IsMTM(reader *bufio.Reader) bool {
+	header, e := reader.Peek(4)
+	if e != nil {
+		return false
+	}
+	return string(header[0:3]) == "MTM" && header[3] >= 0x10
+}
+
+/* Decodes a MultiTracker module. Patterns are lists of tracks, which hold 64 rows of MOD-style notes for one channel and may be shared. */
+func DecodeMTM(reader *bufio.Reader) (*Module, error) {
+	buff, e := ioutil.ReadAll(reader)
+	if e != nil {
+		return nil, e
+	}
+	if e := checkBounds("mtm", buff, 0, 66, "header"); e != nil {
+		return nil, e
+	}
+	m := NewModule()
+
+	m.songName = string(buff[4:24])
+	numTracks := int(binary.LittleEndian.Uint16(buff[24:]))
+	m.numPatterns = int(buff[26]) + 1
+	m.sequenceLength = int(buff[27]) + 1
+	commentLength := int(binary.LittleEndian.Uint16(buff[28:]))
+	numSamples := int(buff[30])
+	numRows := int(buff[32])
+	if numRows < 1 || numRows > 64 {
+		numRows = 64
+	}
+	m.numChannels = int(buff[33])
+	if m.numChannels < 1 || m.numChannels > 32 {
+		return nil, &DecodeError{"mtm", 33, "invalid channel count"}
+	}
+	m.c2Rate = NTSC
+	m.gain = 32
+	m.defaultGVol = 64
+	m.defaultSpeed = 6
+	m.defaultTempo = 125
+	m.defaultPanning = make([]int, m.numChannels)
+	for idx := range m.defaultPanning {
+		m.defaultPanning[idx] = int(buff[34+idx]&0xF) * 17
+	}
+
+	offset := 66 + numSamples*37
+	if e := checkBounds("mtm", buff, offset, 128, "sequence"); e != nil {
+		return nil, e
+	}
+	m.sequence = make([]int, m.sequenceLength)
+	for seqIdx := range m.sequence {
+		m.sequence[seqIdx] = int(buff[offset+seqIdx])
+	}
+	offset += 128
+
+	/* Track 0 is empty and not stored. */
+	trackOffset := offset
+	offset += numTracks * 192
+	if e := checkBounds("mtm", buff, trackOffset, numTracks*192+m.numPatterns*64, "tracks"); e != nil {
+		return nil, e
+	}
+	m.patterns = make([]*Pattern, m.numPatterns)
+	for patIdx := range m.patterns {
+		pattern := NewPattern(m.numChannels, numRows)
+		m.patterns[patIdx] = pattern
+		for chanIdx := 0; chanIdx < 32; chanIdx++ {
+			track := int(binary.LittleEndian.Uint16(buff[offset:]))
+			offset += 2
+			if track < 1 || track > numTracks || chanIdx >= m.numChannels {
+				continue
+			}
+			trackData := buff[trackOffset+(track-1)*192:]
+			for row := 0; row < numRows; row++ {
+				noteIdx := (row*m.numChannels + chanIdx) * 5
+				key := int(trackData[row*3] >> 2)
+				if key > 0 {
+					key += 25
+				}
+				pattern.data[noteIdx] = byte(key)
+				pattern.data[noteIdx+1] = (trackData[row*3]&0x3)<<4 | trackData[row*3+1]>>4
+				pattern.data[noteIdx+3], pattern.data[noteIdx+4] = convertMODEffect(trackData[row*3+1]&0xF, trackData[row*3+2])
+			}
+		}
+	}
+	offset += commentLength
+
+	m.numInstruments = numSamples
+	m.instruments = make([]*Instrument, numSamples+1)
+	m.instruments[0] = DefaultInstrument()
+	for insIdx := 1; insIdx <= numSamples; insIdx++ {
+		instrument := DefaultInstrument()
+		m.instruments[insIdx] = instrument
+		sample := instrument.samples[0]
+		header := buff[66+(insIdx-1)*37:]
+		instrument.name = string(header[0:22])
+		sample.name = instrument.name
+		sampleLength := int(binary.LittleEndian.Uint32(header[22:]))
+		loopStart := int(binary.LittleEndian.Uint32(header[26:]))
+		loopLength := int(binary.LittleEndian.Uint32(header[30:])) - loopStart
+		fineTune := int(header[34]&0xF) << 4
+		sample.fineTune = fineTune - 256
+		if fineTune < 128 {
+			sample.fineTune = fineTune
+		}
+		sample.volume = int(header[35])
+		if sample.volume > 64 {
+			sample.volume = 64
+		}
+		sample.panning = -1
+		sample.c2Rate = m.c2Rate
+		sixteenBit := header[36]&0x1 == 0x1
+		bytesPerSample := 1
+		if sixteenBit {
+			bytesPerSample = 2
+		}
+		if sampleLength < 0 || offset+sampleLength > len(buff) {
+			sampleLength = 0
+			if offset < len(buff) {
+				sampleLength = len(buff) - offset
+			}
+		}
+		sampleData := make([]int16, sampleLength/bytesPerSample)
+		for idx := range sampleData {
+			if sixteenBit {
+				sampleData[idx] = int16(binary.LittleEndian.Uint16(buff[offset+idx*2:]))
+			} else {
+				sampleData[idx] = int16(int(buff[offset+idx])-128) << 8
+			}
+		}
+		offset += sampleLength
+		loopStart /= bytesPerSample
+		loopLength /= bytesPerSample
+		if loopLength < 2 || loopStart < 0 || loopStart+loopLength > len(sampleData) {
+			loopStart = len(sampleData)
+			loopLength = 0
+		}
+		sample.setSampleData(sampleData, loopStart, loopLength, false)
+	}
+	if e := m.checkSequence("mtm"); e != nil {
+		return nil, e
+	}
+	return m, nil
+}
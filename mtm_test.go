@@ -0,0 +1,127 @@
+package ibxmgo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+/* Returns a 3-channel MultiTracker module with 32-row patterns built from two shared tracks, an 8-bit and a 16-bit sample. */
+func mtmModule() []byte {
+	buff := make([]byte, 66)
+	copy(buff, "MTM\x10multitracker")
+	binary.LittleEndian.PutUint16(buff[24:], 2)
+	buff[26], buff[27] = 1, 2
+	binary.LittleEndian.PutUint16(buff[28:], 4)
+	buff[30], buff[32], buff[33] = 2, 32, 3
+	copy(buff[34:], []byte{3, 12, 7})
+
+	sample := make([]byte, 37)
+	copy(sample, "eight bit")
+	binary.LittleEndian.PutUint32(sample[22:], 100)
+	binary.LittleEndian.PutUint32(sample[26:], 20)
+	binary.LittleEndian.PutUint32(sample[30:], 80)
+	sample[35] = 48
+	buff = append(buff, sample...)
+	sample = make([]byte, 37)
+	copy(sample, "sixteen bit")
+	binary.LittleEndian.PutUint32(sample[22:], 80)
+	sample[35], sample[36] = 70, 1
+	buff = append(buff, sample...)
+
+	sequence := make([]byte, 128)
+	copy(sequence, []byte{1, 0, 1})
+	buff = append(buff, sequence...)
+
+	tracks := make([]byte, 2*192)
+	/* Track 1 row 0: key 49, instrument 1, set volume. */
+	copy(tracks[0:], []byte{24 << 2, 0x1C, 0x20})
+	/* Track 2 row 3: key 37, instrument 2, volume slide. */
+	copy(tracks[192+3*3:], []byte{12 << 2, 0x2A, 0x01})
+	buff = append(buff, tracks...)
+
+	patterns := make([]byte, 2*64)
+	for idx, track := range []uint16{1, 2, 0, 2, 3, 1} {
+		binary.LittleEndian.PutUint16(patterns[idx/3*64+idx%3*2:], track)
+	}
+	buff = append(buff, patterns...)
+	buff = append(buff, "note"...)
+
+	for idx := 0; idx < 100; idx++ {
+		buff = append(buff, byte(idx))
+	}
+	for idx := 0; idx < 40; idx++ {
+		buff = binary.LittleEndian.AppendUint16(buff, uint16(idx*1000-20000))
+	}
+	return buff
+}
+
+func TestDecodeMTM(t *testing.T) {
+	m, e := Decode(bytes.NewReader(mtmModule()))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if m.Format() != "mtm" || m.NumChannels() != 3 || m.C2Rate() != NTSC {
+		t.Errorf("format %q with %d channels, C2 rate %d", m.Format(), m.NumChannels(), m.C2Rate())
+	}
+	if panning := m.DefaultPanning(); !reflect.DeepEqual(panning, []int{3 * 17, 12 * 17, 7 * 17}) {
+		t.Errorf("panning %v", panning)
+	}
+	if sequence := m.Sequence(); !reflect.DeepEqual(sequence, []int{1, 0, 1}) {
+		t.Errorf("sequence %v, want [1 0 1]", sequence)
+	}
+	if len(m.Patterns()) != 2 {
+		t.Fatalf("%d patterns, want 2", len(m.Patterns()))
+	}
+
+	track1 := map[int]Note{0: {Key: 49, Instrument: 1, Effect: 0xC, Param: 0x20}}
+	if text := track1[0].Text("mtm"); !strings.HasPrefix(text, "C-2 ") {
+		t.Errorf("note 24 shown as %q, want C-2", text)
+	}
+	track2 := map[int]Note{3: {Key: 37, Instrument: 2, Effect: 0xA, Param: 0x01}}
+	/* Track 0 is empty and track 3 does not exist. */
+	tracks := [][]map[int]Note{{track1, track2, nil}, {track2, nil, track1}}
+	for patIdx, pattern := range m.Patterns() {
+		if pattern.NumRows() != 32 {
+			t.Errorf("pattern %d: %d rows, want 32", patIdx, pattern.NumRows())
+		}
+		for chanIdx, track := range tracks[patIdx] {
+			for row := 0; row < pattern.NumRows(); row++ {
+				if note := pattern.Note(row, chanIdx); note != track[row] {
+					t.Errorf("pattern %d channel %d row %d: %+v, want %+v", patIdx, chanIdx, row, note, track[row])
+				}
+			}
+		}
+	}
+
+	eightBit := make([]int16, 100)
+	for idx := range eightBit {
+		eightBit[idx] = int16(idx-128) << 8
+	}
+	sixteenBit := make([]int16, 40)
+	for idx := range sixteenBit {
+		sixteenBit[idx] = int16(idx*1000 - 20000)
+	}
+	samples := []struct {
+		data                  []int16
+		loopStart, loopLength int
+		volume                int
+	}{
+		{eightBit[:80], 20, 60, 48},
+		{sixteenBit, 0, 0, 64},
+	}
+	for idx, test := range samples {
+		sample := m.Instruments()[idx].Samples()[0]
+		if data := sample.Data(); !reflect.DeepEqual(data, test.data) {
+			t.Errorf("sample %d: data %v", idx+1, data)
+		}
+		if start, length := sample.Loop(); start != test.loopStart || length != test.loopLength {
+			t.Errorf("sample %d: loop %d+%d, want %d+%d", idx+1, start, length, test.loopStart, test.loopLength)
+		}
+		if sample.Volume() != test.volume {
+			t.Errorf("sample %d: volume %d, want %d", idx+1, sample.Volume(), test.volume)
+		}
+	}
+}
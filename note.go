@@ -1,5 +1,6 @@
 package ibxmgo
 
+/* Note holds the fields of an entry in a pattern. Pattern.Note returns a copy, so changes only reach the pattern through Pattern.SetNote. Effect and Param use the numbering of the format the module was decoded from. */
 type Note struct {
-	key, instrument, volume, effect, param int
+	Key, Instrument, Volume, Effect, Param int
 }
@@ -7,13 +7,71 @@ type Pattern struct {
 
 func (this *Pattern) getNote(index int, note *Note) {
 	offset := index * 5
-	note.key = int(this.data[offset])
-	note.instrument = int(this.data[offset+1])
-	note.volume = int(this.data[offset+2])
-	note.effect = int(this.data[offset+3])
-	note.param = int(this.data[offset+4])
+	note.Key = int(this.data[offset])
+	note.Instrument = int(this.data[offset+1])
+	note.Volume = int(this.data[offset+2])
+	note.Effect = int(this.data[offset+3])
+	note.Param = int(this.data[offset+4])
 }
 
 func NewPattern(numChannels, numRows int) *Pattern {
 	return &Pattern{numRows, make([]byte, numChannels*numRows*5)}
 }
+
+func (this *Pattern) NumRows() int {
+	return this.numRows
+}
+
+func (this *Pattern) NumChannels() int {
+	if this.numRows < 1 {
+		return 0
+	}
+	return len(this.data) / (this.numRows * 5)
+}
+
+/* Returns the note at row and channel, or an empty note if either is out of range. */
+func (this *Pattern) Note(row, channel int) Note {
+	var note Note
+	numChannels := this.NumChannels()
+	if row >= 0 && row < this.numRows && channel >= 0 && channel < numChannels {
+		this.getNote(row*numChannels+channel, &note)
+	}
+	return note
+}
+
+/* Sets the note at row and channel. Key is 0 for no note, 1 to 96, or 97 for key off. */
+func (this *Pattern) SetNote(row, channel int, note Note) error {
+	numChannels := this.NumChannels()
+	if row < 0 || row >= this.numRows || channel < 0 || channel >= numChannels {
+		return IndexOutOfRange
+	}
+	if note.Key < 0 || note.Key > 97 || note.Instrument < 0 || note.Instrument > 255 ||
+		note.Volume < 0 || note.Volume > 255 || note.Effect < 0 || note.Effect > 255 ||
+		note.Param < 0 || note.Param > 255 {
+		return ValueOutOfRange
+	}
+	offset := (row*numChannels + channel) * 5
+	this.data[offset] = byte(note.Key)
+	this.data[offset+1] = byte(note.Instrument)
+	this.data[offset+2] = byte(note.Volume)
+	this.data[offset+3] = byte(note.Effect)
+	this.data[offset+4] = byte(note.Param)
+	return nil
+}
+
+/* Changes the number of channels, keeping the notes of the remaining channels. */
+func (this *Pattern) resize(numChannels int) {
+	oldChannels := this.NumChannels()
+	if numChannels == oldChannels {
+		return
+	}
+	data := make([]byte, numChannels*this.numRows*5)
+	count := oldChannels
+	if numChannels < count {
+		count = numChannels
+	}
+	for row := 0; row < this.numRows; row++ {
+		copy(data[row*numChannels*5:], this.data[row*oldChannels*5:(row*oldChannels+count)*5])
+	}
+	this.data = data
+}
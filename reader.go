@@ -0,0 +1,55 @@
+package ibxmgo
+
+import (
+	"io"
+)
+
+/* PCMReader renders interleaved stereo little-endian PCM from an IBXM as an io.Reader. */
+type PCMReader struct {
+	ibxm           *IBXM
+	format         SampleFormat
+	loop, songEnd  bool
+	mixBuf         []int32
+	buff           []byte
+	offset, length int
+}
+
+/* Returns a reader producing audio from the current position of ibxm. */
+func NewPCMReader(ibxm *IBXM, format SampleFormat) (*PCMReader, error) {
+	if format != INT16 && format != FLOAT32 {
+		return nil, UnsupportedSampleFormat
+	}
+	this := &PCMReader{}
+	this.ibxm = ibxm
+	this.format = format
+	this.mixBuf = make([]int32, ibxm.AudioBufferLength())
+	this.buff = make([]byte, len(this.mixBuf)*format.bytes())
+	return this, nil
+}
+
+/* If loop is true, the song is played forever and io.EOF is never returned. */
+func (this *PCMReader) SetLoop(loop bool) {
+	this.loop = loop
+}
+
+func (this *PCMReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if this.offset >= this.length {
+			if this.songEnd && !this.loop {
+				break
+			}
+			samples, songEnd := this.ibxm.GetAudio(this.mixBuf)
+			this.length = this.format.encode(this.buff, this.mixBuf[:samples*2])
+			this.offset = 0
+			this.songEnd = songEnd
+		}
+		count := copy(p[n:], this.buff[this.offset:this.length])
+		this.offset += count
+		n += count
+	}
+	if n == 0 && len(p) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
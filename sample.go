@@ -26,6 +26,7 @@ type Sample struct {
 	volume, panning, relNote, fineTune int
 	c2Rate                             C2Rate
 	loopStart, loopLength              int
+	pingPong                           bool
 	sampleData                         []int16
 	name                               string
 }
@@ -34,6 +35,123 @@ func (this *Sample) looped() bool {
 	return this.loopLength > 1
 }
 
+/* Returns the sample name with padding removed. */
+func (this *Sample) Name() string {
+	return trimName(this.name)
+}
+
+/* Returns the default volume (0 to 64). */
+func (this *Sample) Volume() int {
+	return this.volume
+}
+
+/* Returns the default panning (0 to 255). */
+func (this *Sample) Panning() int {
+	return this.panning
+}
+
+func (this *Sample) RelNote() int {
+	return this.relNote
+}
+
+func (this *Sample) FineTune() int {
+	return this.fineTune
+}
+
+func (this *Sample) C2Rate() C2Rate {
+	return this.c2Rate
+}
+
+/* Returns a copy of the sample data as played. Ping-pong loops are stored unrolled. */
+func (this *Sample) Data() []int16 {
+	if len(this.sampleData) < DELAY {
+		return nil
+	}
+	return append([]int16(nil), this.sampleData[DELAY:this.loopStart+this.loopLength]...)
+}
+
+/* Returns the loop start and length in samples. The length is 0 if the sample is not looped. */
+func (this *Sample) Loop() (start, length int) {
+	if !this.looped() {
+		return 0, 0
+	}
+	return this.loopStart - DELAY, this.loopLength
+}
+
+/* Returns true if the loop plays forwards and backwards. Data and Loop return such loops unrolled. */
+func (this *Sample) PingPong() bool {
+	return this.pingPong && this.looped()
+}
+
+/* Returns an empty sample at full volume that uses the channel panning. */
+func NewSample() *Sample {
+	this := &Sample{volume: 64, panning: -1, c2Rate: NTSC}
+	this.setSampleData(nil, 0, 0, false)
+	return this
+}
+
+func (this *Sample) SetName(name string) {
+	this.name = name
+}
+
+/* Sets the default volume (0 to 64). */
+func (this *Sample) SetVolume(volume int) error {
+	if volume < 0 || volume > 64 {
+		return ValueOutOfRange
+	}
+	this.volume = volume
+	return nil
+}
+
+/* Sets the default panning (0 to 255), or -1 to use the channel panning. */
+func (this *Sample) SetPanning(panning int) error {
+	if panning < -1 || panning > 255 {
+		return ValueOutOfRange
+	}
+	this.panning = panning
+	return nil
+}
+
+/* Sets the pitch in semitones relative to C-4 (-96 to 95). */
+func (this *Sample) SetRelNote(relNote int) error {
+	if relNote < -96 || relNote > 95 {
+		return ValueOutOfRange
+	}
+	this.relNote = relNote
+	return nil
+}
+
+/* Sets the fine tune in 1/128ths of a semitone (-128 to 127). */
+func (this *Sample) SetFineTune(fineTune int) error {
+	if fineTune < -128 || fineTune > 127 {
+		return ValueOutOfRange
+	}
+	this.fineTune = fineTune
+	return nil
+}
+
+/* Sets the playback rate of C-4 used when the module does not use linear periods. */
+func (this *Sample) SetC2Rate(c2Rate C2Rate) error {
+	if c2Rate <= 0 {
+		return ValueOutOfRange
+	}
+	this.c2Rate = c2Rate
+	return nil
+}
+
+/* Replaces the sample data. A loopLength of 0 disables the loop. Ping-pong loops are unrolled, doubling the loop length. */
+func (this *Sample) SetData(data []int16, loopStart, loopLength int, pingPong bool) error {
+	if loopStart < 0 || loopLength < 0 || loopStart+loopLength > len(data) {
+		return ValueOutOfRange
+	}
+	if loopLength == 0 {
+		loopStart = len(data)
+		pingPong = false
+	}
+	this.setSampleData(data, loopStart, loopLength, pingPong)
+	return nil
+}
+
 func (this *Sample) normaliseSampleIdx(sampleIdx int) int {
 	loopOffset := sampleIdx - this.loopStart
 	if loopOffset > 0 {
@@ -83,6 +201,7 @@ func (this *Sample) setSampleData(sampleData []int16, loopStart, loopLength int,
 	this.sampleData = sampleData
 	this.loopStart = loopStart
 	this.loopLength = loopLength
+	this.pingPong = pingPong
 }
 
 func (this *Sample) resampleLinear(sampleIdx, sampleFrac, step,
@@ -0,0 +1,180 @@
+package ibxmgo
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io/ioutil"
+)
+
+/* Tick shortening factors for the fine part of Scream Tracker 2 speeds, indexed by the ticks per row. */
+var stmTempoFactors = []int{140, 50, 25, 15, 10, 7, 6, 4, 3, 3, 2, 2, 2, 2, 1, 1}
+
+/* Returns true for Scream Tracker 2 modules. The tracker name field is not fixed, as converters write their own. */
+func IsSTM(reader *bufio.Reader) bool {
+	header, e := reader.Peek(48)
+	if e != nil {
+		return false
+	}
+	for _, c := range header[20:28] {
+		if c < 0x20 || c > 0x7E {
+			return false
+		}
+	}
+	return header[28] == 0x1A && header[29] == 2 && header[30] == 2
+}
+
+/* Returns the ticks per row and tempo of a packed Scream Tracker 2 speed, which has the ticks per row in the high nibble and a low nibble that shortens each tick. */
+func stmSpeed(packed, version int) (speed, tempo int) {
+	if version < 21 {
+		/* Older versions store the speed in decimal. */
+		packed = (packed/10)<<4 + packed%10
+	}
+	speed = packed >> 4 & 0xF
+	tempo = (49 - (stmTempoFactors[speed]*(packed&0xF))>>4) * 5 / 2
+	if tempo < 32 {
+		tempo = 32
+	}
+	return speed, tempo
+}
+
+/* Decodes a Scream Tracker 2 module, which has 31 samples and 4 channels of unpacked 64-row patterns. */
+func DecodeSTM(reader *bufio.Reader) (*Module, error) {
+	buff, e := ioutil.ReadAll(reader)
+	if e != nil {
+		return nil, e
+	}
+	if e := checkBounds("stm", buff, 0, 1168, "header"); e != nil {
+		return nil, e
+	}
+	m := NewModule()
+
+	m.songName = string(buff[0:20])
+	version := int(buff[31])
+	m.numPatterns = int(buff[33])
+	m.numChannels = 4
+	m.numInstruments = 31
+	m.c2Rate = NTSC
+	m.gain = 64
+	m.defaultGVol = int(buff[34])
+	if m.defaultGVol > 64 {
+		m.defaultGVol = 64
+	}
+	m.defaultSpeed, m.defaultTempo = stmSpeed(int(buff[32]), version)
+	if m.defaultSpeed == 0 {
+		m.defaultSpeed = 6
+	}
+	/* Panned as Scream Tracker 3 loads these files. */
+	m.defaultPanning = []int{3 * 17, 12 * 17, 3 * 17, 12 * 17}
+
+	/* The sequence ends at the first entry of 99 or more. */
+	m.sequence = make([]int, 0, 128)
+	for seqIdx := 0; seqIdx < 128 && buff[1040+seqIdx] < 99; seqIdx++ {
+		m.sequence = append(m.sequence, int(buff[1040+seqIdx]))
+	}
+	m.sequenceLength = len(m.sequence)
+
+	if e := checkBounds("stm", buff, 1168, m.numPatterns*1024, "pattern data"); e != nil {
+		return nil, e
+	}
+	m.patterns = make([]*Pattern, m.numPatterns)
+	for patIdx := range m.patterns {
+		pattern := NewPattern(m.numChannels, 64)
+		m.patterns[patIdx] = pattern
+		patData := buff[1168+patIdx*1024:]
+		for noteIdx := 0; noteIdx < 256; noteIdx++ {
+			key := int(patData[noteIdx*4])
+			switch {
+			case key == 0xFE:
+				/* Note cut, as stored by DecodeS3M. */
+			case key < 0xFB && key&0xF < 12:
+				key = (key>>4)*12 + (key & 0xF) + 25
+				if key > 96 {
+					key = 0
+				}
+			default:
+				key = 0
+			}
+			volume := int(patData[noteIdx*4+1]&0x7) | int(patData[noteIdx*4+2]&0xF0)>>1
+			if volume > 64 {
+				volume = 0
+			} else {
+				volume += 0x10
+			}
+			pattern.data[noteIdx*5] = byte(key)
+			pattern.data[noteIdx*5+1] = patData[noteIdx*4+1] >> 3
+			pattern.data[noteIdx*5+2] = byte(volume)
+			pattern.data[noteIdx*5+3], pattern.data[noteIdx*5+4] = convertSTMEffect(patData[noteIdx*4+2]&0xF, patData[noteIdx*4+3], version)
+		}
+	}
+
+	m.instruments = make([]*Instrument, m.numInstruments+1)
+	m.instruments[0] = DefaultInstrument()
+	for insIdx := 1; insIdx <= m.numInstruments; insIdx++ {
+		instrument := DefaultInstrument()
+		m.instruments[insIdx] = instrument
+		sample := instrument.samples[0]
+		header := buff[48+(insIdx-1)*32:]
+		instrument.name = string(header[0:12])
+		sample.name = instrument.name
+		sampleOffset := int(binary.LittleEndian.Uint16(header[14:])) << 4
+		sampleLength := int(binary.LittleEndian.Uint16(header[16:]))
+		loopStart := int(binary.LittleEndian.Uint16(header[18:]))
+		loopEnd := int(binary.LittleEndian.Uint16(header[20:]))
+		sample.volume = int(header[22])
+		if sample.volume > 64 {
+			sample.volume = 64
+		}
+		sample.panning = -1
+		sample.c2Rate = C2Rate(binary.LittleEndian.Uint16(header[24:]))
+		if sample.c2Rate <= 0 {
+			sample.c2Rate = NTSC
+		}
+		if sampleOffset == 0 {
+			sampleLength = 0
+		}
+		sampleData := make([]int16, available(buff, sampleOffset, sampleLength, 1))
+		for idx := range sampleData {
+			sampleData[idx] = int16(buff[sampleOffset+idx]) << 8
+		}
+		/* A loop end of 0xFFFF means no loop. */
+		loopLength := loopEnd - loopStart
+		if loopEnd == 0xFFFF || loopEnd > len(sampleData) || loopLength < 2 {
+			loopStart = len(sampleData)
+			loopLength = 0
+		}
+		sample.setSampleData(sampleData, loopStart, loopLength, false)
+	}
+	if e := m.checkSequence("stm"); e != nil {
+		return nil, e
+	}
+	return m, nil
+}
+
+/* Converts a Scream Tracker 2 effect to the numbering DecodeS3M uses. Scream Tracker 2 has no effect memory or fine slides, so effects that would use them in Scream Tracker 3 are changed. */
+func convertSTMEffect(effect, param byte, version int) (byte, byte) {
+	switch effect {
+	case 0x1: /* Set Speed. The fine part of the speed is not supported. */
+		speed, _ := stmSpeed(int(param), version)
+		if speed == 0 {
+			return 0, 0
+		}
+		return 0x81, byte(speed)
+	case 0x4: /* Volume Slide. */
+		if param&0xF0 != 0 {
+			param &= 0xF0
+		}
+	case 0x5, 0x6: /* Portamento Down/Up. */
+		if param > 0xDF {
+			param = 0xDF
+		}
+	case 0x2, 0x3, 0x7, 0x8, 0x9:
+		return 0x80 + effect, param
+	case 0xA: /* Arpeggio. */
+	default:
+		return 0, 0
+	}
+	if param == 0 {
+		return 0, 0
+	}
+	return 0x80 + effect, param
+}
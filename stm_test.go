@@ -0,0 +1,136 @@
+package ibxmgo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestSTMSpeed(t *testing.T) {
+	tests := []struct {
+		packed, version      int
+		wantSpeed, wantTempo int
+	}{
+		{0x60, 21, 6, 122},
+		{0x64, 21, 6, 120},
+		{60, 10, 6, 122},
+		{0x1F, 21, 1, 32},
+		{0x00, 21, 0, 122},
+	}
+	for _, test := range tests {
+		if speed, tempo := stmSpeed(test.packed, test.version); speed != test.wantSpeed || tempo != test.wantTempo {
+			t.Errorf("stmSpeed(%#x, %d) = %d, %d, want %d, %d", test.packed, test.version, speed, tempo, test.wantSpeed, test.wantTempo)
+		}
+	}
+}
+
+/* Returns a Scream Tracker 2 module with one pattern played twice and two samples. */
+func stmModule() []byte {
+	buff := make([]byte, 1168)
+	copy(buff, "screamtracker")
+	copy(buff[20:], "!Scream!\x1A\x02\x02")
+	buff[31], buff[32], buff[33], buff[34] = 21, 0x64, 1, 48
+
+	sample := buff[48:]
+	copy(sample, "looped")
+	binary.LittleEndian.PutUint16(sample[14:], 137)
+	binary.LittleEndian.PutUint16(sample[16:], 32)
+	binary.LittleEndian.PutUint16(sample[18:], 8)
+	binary.LittleEndian.PutUint16(sample[20:], 24)
+	sample[22] = 50
+	binary.LittleEndian.PutUint16(sample[24:], 8000)
+	sample = buff[48+32:]
+	copy(sample, "one shot")
+	binary.LittleEndian.PutUint16(sample[14:], 139)
+	binary.LittleEndian.PutUint16(sample[16:], 16)
+	binary.LittleEndian.PutUint16(sample[20:], 0xFFFF)
+	sample[22] = 80
+
+	for idx := 1040; idx < 1168; idx++ {
+		buff[idx] = 99
+	}
+	buff[1040], buff[1041] = 0, 0
+
+	pattern := bytes.Repeat([]byte{0xFF, 0x01, 0x80, 0x00}, 256)
+	cells := []struct {
+		row, chanIdx int
+		data         []byte
+	}{
+		{0, 0, []byte{0x24, 0x08, 0x51, 0x40}}, /* Key, instrument 1, volume 40 and speed. */
+		{0, 1, []byte{0xFE, 0x01, 0x84, 0x23}}, /* Note cut and volume slide. */
+		{1, 0, []byte{0xFF, 0x01, 0x85, 0xF0}}, /* Portamento down past the fine range. */
+		{1, 2, []byte{0xFF, 0x01, 0x84, 0x00}}, /* Volume slide without a parameter. */
+		{1, 3, []byte{0x4B, 0x10, 0x88, 0x44}}, /* Key, instrument 2, volume 64 and vibrato. */
+		{2, 0, []byte{0x0C, 0x01, 0x8B, 0x01}}, /* Invalid key and an unsupported effect. */
+	}
+	for _, cell := range cells {
+		copy(pattern[(cell.row*4+cell.chanIdx)*4:], cell.data)
+	}
+	buff = append(buff, pattern...)
+
+	for idx := 0; idx < 48; idx++ {
+		buff = append(buff, byte(idx*5))
+	}
+	return buff
+}
+
+func TestDecodeSTM(t *testing.T) {
+	m, e := Decode(bytes.NewReader(stmModule()))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if m.Format() != "stm" || m.NumChannels() != 4 || m.DefaultGlobalVolume() != 48 {
+		t.Errorf("format %q with %d channels, global volume %d", m.Format(), m.NumChannels(), m.DefaultGlobalVolume())
+	}
+	if m.DefaultSpeed() != 6 || m.DefaultTempo() != 120 {
+		t.Errorf("speed %d tempo %d, want 6 120", m.DefaultSpeed(), m.DefaultTempo())
+	}
+	if sequence := m.Sequence(); !reflect.DeepEqual(sequence, []int{0, 0}) {
+		t.Errorf("sequence %v, want [0 0]", sequence)
+	}
+
+	tests := []struct {
+		row, chanIdx int
+		want         Note
+	}{
+		{0, 0, Note{Key: 53, Instrument: 1, Volume: 0x10 + 40, Effect: 0x81, Param: 4}},
+		{0, 1, Note{Key: 254, Effect: 0x84, Param: 0x20}},
+		{0, 2, Note{}},
+		{1, 0, Note{Effect: 0x85, Param: 0xDF}},
+		{1, 2, Note{}},
+		{1, 3, Note{Key: 84, Instrument: 2, Volume: 0x10 + 64, Effect: 0x88, Param: 0x44}},
+		{2, 0, Note{}},
+	}
+	for _, test := range tests {
+		if note := m.patterns[0].Note(test.row, test.chanIdx); note != test.want {
+			t.Errorf("row %d channel %d: %+v, want %+v", test.row, test.chanIdx, note, test.want)
+		}
+	}
+
+	samples := []struct {
+		offset, length        int
+		loopStart, loopLength int
+		volume                int
+		c2Rate                C2Rate
+	}{
+		{0, 24, 8, 16, 50, 8000},
+		{32, 16, 0, 0, 64, NTSC},
+	}
+	for idx, test := range samples {
+		sample := m.Instruments()[idx].Samples()[0]
+		want := make([]int16, test.length)
+		for dataIdx := range want {
+			want[dataIdx] = int16(int8((test.offset+dataIdx)*5)) << 8
+		}
+		if data := sample.Data(); !reflect.DeepEqual(data, want) {
+			t.Errorf("sample %d: data %v, want %v", idx+1, data, want)
+		}
+		if start, length := sample.Loop(); start != test.loopStart || length != test.loopLength {
+			t.Errorf("sample %d: loop %d+%d, want %d+%d", idx+1, start, length, test.loopStart, test.loopLength)
+		}
+		if sample.Volume() != test.volume || sample.C2Rate() != test.c2Rate {
+			t.Errorf("sample %d: volume %d C2 rate %d, want %d %d", idx+1, sample.Volume(), sample.C2Rate(), test.volume, test.c2Rate)
+		}
+	}
+}
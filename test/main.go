@@ -32,9 +32,9 @@ func main() {
 	//f2, _ := os.Create("./output.raw")
 	//ibxm.Dump(f2)
 	//return
-	duration := ibxm.SongDuration()
+	duration := ibxm.Length()
 
-	data := make([]int32, ibxm.MixBufferLength())
+	data := make([]int32, ibxm.AudioBufferLength())
 	data2 := make([]int16, duration*2)
 
 	s := time.Now()
@@ -0,0 +1,134 @@
+package ibxmgo
+
+import (
+	"fmt"
+	"strings"
+)
+
+var (
+	keyNames     = []string{"C-", "C#", "D-", "D#", "E-", "F-", "F#", "G-", "G#", "A-", "A#", "B-"}
+	base36Digits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	/* Volume column commands 0x60 to 0xF0, as Fast Tracker 2 shows them with ASCII symbols for the arrows. */
+	volumeCommands = "-+DUSVPLRM"
+)
+
+/* Returns true if format names notes and effects like Scream Tracker 3 rather than Fast Tracker 2. */
+func letterEffects(format string) bool {
+	return format == "s3m" || format == "it" || format == "stm"
+}
+
+func keyText(key int, format string) string {
+	switch {
+	case key == 0:
+		return "..."
+	case key == 97:
+		return "==="
+	case key > 97:
+		return "^^^"
+	}
+	octave := (key - 1) / 12
+	switch format {
+	case "mod", "mtm", "669":
+		/* ProTracker C-1 (period 856) is key 37. MultiTracker and Composer 669 notes are numbered the same way. */
+		octave -= 2
+	case "stm":
+		/* Scream Tracker 2 notes are two octaves below Scream Tracker 3 notes of the same pitch. */
+		octave -= 2
+	case "it":
+		octave++
+	}
+	if octave < 0 || octave > 9 {
+		return keyNames[(key-1)%12] + "?"
+	}
+	return fmt.Sprintf("%s%d", keyNames[(key-1)%12], octave)
+}
+
+func volumeText(volume int, format string) string {
+	switch {
+	case volume < 0x10:
+		return ".."
+	case volume <= 0x50:
+		if letterEffects(format) {
+			return fmt.Sprintf("%02d", volume-0x10)
+		}
+		return fmt.Sprintf("%02X", volume-0x10)
+	case volume < 0x60:
+		return ".."
+	}
+	return fmt.Sprintf("%c%X", volumeCommands[(volume>>4)-6], volume&0xF)
+}
+
+func effectText(effect, param int, format string) string {
+	if effect >= 0x81 && effect <= 0x9A {
+		return fmt.Sprintf("%c%02X", 'A'+effect-0x81, param)
+	}
+	if effect == 0 && (param == 0 || letterEffects(format)) {
+		return "..."
+	}
+	if effect >= 0x40 && effect <= 0x43 {
+		return fmt.Sprintf("%c%02X", 'a'+effect-0x40, param)
+	}
+	if format == "669" {
+		/* Composer 669 commands, which have a single parameter digit. */
+		switch effect {
+		case 0x04:
+			return fmt.Sprintf("e%02X", param&0xF)
+		case 0x08:
+			return fmt.Sprintf("g%02X", param/17)
+		case 0x0F:
+			return fmt.Sprintf("f%02X", param)
+		case 0x1B:
+			return fmt.Sprintf("h%02X", param)
+		}
+	}
+	if effect < len(base36Digits) {
+		if format == "it" {
+			/* Effects the IT decoder stores in the XM numbering. */
+			switch effect {
+			case 0x08:
+				return fmt.Sprintf("X%02X", param)
+			case 0x11:
+				return fmt.Sprintf("W%02X", param)
+			case 0x19:
+				return fmt.Sprintf("P%X%X", param&0xF, param>>4)
+			}
+		}
+		return fmt.Sprintf("%c%02X", base36Digits[effect], param)
+	}
+	return fmt.Sprintf("?%02X", param)
+}
+
+/* Returns the note as tracker text such as "C-4 01 40 A0F", named as the tracker for format ("mod", "xm", "s3m", "it", "669", "stm" or "mtm") would show it. Empty fields are shown as dots. */
+func (this Note) Text(format string) string {
+	instrument := ".."
+	if this.Instrument > 0 {
+		if letterEffects(format) {
+			instrument = fmt.Sprintf("%02d", this.Instrument)
+		} else {
+			instrument = fmt.Sprintf("%02X", this.Instrument)
+		}
+	}
+	return keyText(this.Key, format) + " " + instrument + " " +
+		volumeText(this.Volume, format) + " " + effectText(this.Effect, this.Param, format)
+}
+
+/* Returns the pattern as tracker text, one line per row starting with the row number, using Note.Text for each channel. */
+func (this *Pattern) Text(format string) string {
+	var text strings.Builder
+	numChannels := this.NumChannels()
+	rowFormat := "%02d"
+	if this.numRows > 100 {
+		rowFormat = "%03d"
+	}
+	note := &Note{}
+	for row := 0; row < this.numRows; row++ {
+		fmt.Fprintf(&text, rowFormat, row)
+		for channel := 0; channel < numChannels; channel++ {
+			this.getNote(row*numChannels+channel, note)
+			text.WriteString(" | ")
+			text.WriteString(note.Text(format))
+		}
+		text.WriteString("\n")
+	}
+	return text.String()
+}
@@ -0,0 +1,236 @@
+package ibxmgo
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+type SampleFormat int
+
+const (
+	INT16   = SampleFormat(0)
+	FLOAT32 = SampleFormat(1)
+)
+
+var (
+	UnsupportedSampleFormat = errors.New("Unsupported sample format")
+	WAVTooLarge             = errors.New("Audio data too large for a WAV file")
+)
+
+/* Returns the number of bytes used by each amplitude. */
+func (this SampleFormat) bytes() int {
+	if this == FLOAT32 {
+		return 4
+	}
+	return 2
+}
+
+/* Convert amplitudes from GetAudio into little-endian bytes. 16-bit output is clipped, float output is not. */
+func (this SampleFormat) encode(buff []byte, data []int32) int {
+	if this == FLOAT32 {
+		for idx, x := range data {
+			binary.LittleEndian.PutUint32(buff[idx*4:], math.Float32bits(float32(x)/32768))
+		}
+		return len(data) * 4
+	}
+	for idx, x := range data {
+		if x > 32767 {
+			x = 32767
+		} else if x < -32768 {
+			x = -32768
+		}
+		binary.LittleEndian.PutUint16(buff[idx*2:], uint16(x))
+	}
+	return len(data) * 2
+}
+
+/* WAVWriter writes audio from GetAudio or GetStems to a stereo RIFF/WAVE file. */
+type WAVWriter struct {
+	w          io.WriteSeeker
+	start      int64
+	sampleRate int
+	format     SampleFormat
+	buff       []byte
+	dataLength int64
+}
+
+/* Writes a WAV header to w and returns a writer for the audio that follows it. */
+func NewWAVWriter(w io.WriteSeeker, sampleRate int, format SampleFormat) (*WAVWriter, error) {
+	if format != INT16 && format != FLOAT32 {
+		return nil, UnsupportedSampleFormat
+	}
+	start, e := w.Seek(0, io.SeekCurrent)
+	if e != nil {
+		return nil, e
+	}
+	if _, e = w.Write(wavHeader(sampleRate, format, 0)); e != nil {
+		return nil, e
+	}
+	return &WAVWriter{w: w, start: start, sampleRate: sampleRate, format: format}, nil
+}
+
+/* Write interleaved stereo amplitudes, such as data[:samples*2] after GetAudio. */
+func (this *WAVWriter) Write(data []int32) error {
+	if length := len(data) * this.format.bytes(); len(this.buff) < length {
+		this.buff = make([]byte, length)
+	}
+	length := this.format.encode(this.buff, data)
+	if _, e := this.w.Write(this.buff[:length]); e != nil {
+		return e
+	}
+	this.dataLength += int64(length)
+	return nil
+}
+
+/* Patch the header sizes and seek to the end of the audio. The underlying writer is not closed. */
+func (this *WAVWriter) Close() error {
+	header := wavHeader(this.sampleRate, this.format, 0)
+	if int64(len(header))+this.dataLength > math.MaxUint32 {
+		return WAVTooLarge
+	}
+	if _, e := this.w.Seek(this.start, io.SeekStart); e != nil {
+		return e
+	}
+	if _, e := this.w.Write(wavHeader(this.sampleRate, this.format, int(this.dataLength))); e != nil {
+		return e
+	}
+	_, e := this.w.Seek(this.start+int64(len(header))+this.dataLength, io.SeekStart)
+	return e
+}
+
+/* RawWriter writes audio from GetAudio or GetStems as little-endian samples without a header, encoded as in a WAV file. */
+type RawWriter struct {
+	w      io.Writer
+	format SampleFormat
+	buff   []byte
+}
+
+/* Returns a writer for headerless audio to w. */
+func NewRawWriter(w io.Writer, format SampleFormat) (*RawWriter, error) {
+	if format != INT16 && format != FLOAT32 {
+		return nil, UnsupportedSampleFormat
+	}
+	return &RawWriter{w: w, format: format}, nil
+}
+
+/* Write interleaved stereo amplitudes, such as data[:samples*2] after GetAudio. */
+func (this *RawWriter) Write(data []int32) error {
+	if length := len(data) * this.format.bytes(); len(this.buff) < length {
+		this.buff = make([]byte, length)
+	}
+	length := this.format.encode(this.buff, data)
+	_, e := this.w.Write(this.buff[:length])
+	return e
+}
+
+/* Write the whole song as a stereo RIFF/WAVE file, patching the header sizes once the song has ended. Returns EndlessSong if the loop count is zero or less. */
+func (this *IBXM) DumpWAV(w io.WriteSeeker, format SampleFormat) error {
+	if this.loopCount <= 0 {
+		return EndlessSong
+	}
+	writer, e := NewWAVWriter(w, this.sampleRate, format)
+	if e != nil {
+		return e
+	}
+	data := make([]int32, this.AudioBufferLength())
+	t := this.SequencePos()
+	this.SetSequencePos(0)
+	defer this.SetSequencePos(t)
+	for end := false; !end; {
+		var n int
+		n, end = this.GetAudio(data)
+		if e = writer.Write(data[:n*2]); e != nil {
+			return e
+		}
+	}
+	return writer.Close()
+}
+
+/* Write each channel of the whole song to its own WAV file, named prefix_ch01.wav and so on. Returns EndlessSong if the loop count is zero or less. */
+func (this *IBXM) DumpStemsWAV(prefix string, format SampleFormat) error {
+	if this.loopCount <= 0 {
+		return EndlessSong
+	}
+	if format != INT16 && format != FLOAT32 {
+		return UnsupportedSampleFormat
+	}
+	numChannels := this.module.numChannels
+	files := make([]*os.File, 0, numChannels)
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	writers := make([]*WAVWriter, numChannels)
+	for chanIdx := range writers {
+		file, e := os.Create(fmt.Sprintf("%s_ch%02d.wav", prefix, chanIdx+1))
+		if e != nil {
+			return e
+		}
+		files = append(files, file)
+		if writers[chanIdx], e = NewWAVWriter(file, this.sampleRate, format); e != nil {
+			return e
+		}
+	}
+	stems := make([][]int32, numChannels)
+	for chanIdx := range stems {
+		stems[chanIdx] = make([]int32, this.AudioBufferLength())
+	}
+	t := this.SequencePos()
+	this.SetSequencePos(0)
+	defer this.SetSequencePos(t)
+	for end := false; !end; {
+		var n int
+		n, end = this.GetStems(stems)
+		for chanIdx, writer := range writers {
+			if e := writer.Write(stems[chanIdx][:n*2]); e != nil {
+				return e
+			}
+		}
+	}
+	for _, writer := range writers {
+		if e := writer.Close(); e != nil {
+			return e
+		}
+	}
+	for _, file := range files {
+		if e := file.Close(); e != nil {
+			return e
+		}
+	}
+	files = files[:0]
+	return nil
+}
+
+/* Returns a stereo WAV header for dataLength bytes of audio. */
+func wavHeader(sampleRate int, format SampleFormat, dataLength int) []byte {
+	bytesPerSample := format.bytes()
+	fmtLength, formatTag := 16, 1 /* WAVE_FORMAT_PCM */
+	if format == FLOAT32 {
+		fmtLength, formatTag = 18, 3 /* WAVE_FORMAT_IEEE_FLOAT */
+	}
+	header := make([]byte, 0, 58)
+	header = append(header, "RIFF\x00\x00\x00\x00WAVEfmt "...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(fmtLength))
+	header = binary.LittleEndian.AppendUint16(header, uint16(formatTag))
+	header = binary.LittleEndian.AppendUint16(header, 2)
+	header = binary.LittleEndian.AppendUint32(header, uint32(sampleRate))
+	header = binary.LittleEndian.AppendUint32(header, uint32(sampleRate*2*bytesPerSample))
+	header = binary.LittleEndian.AppendUint16(header, uint16(2*bytesPerSample))
+	header = binary.LittleEndian.AppendUint16(header, uint16(bytesPerSample*8))
+	if format == FLOAT32 {
+		/* Non-PCM formats have an extension size and a fact chunk with the frame count. */
+		header = binary.LittleEndian.AppendUint16(header, 0)
+		header = append(header, "fact"...)
+		header = binary.LittleEndian.AppendUint32(header, 4)
+		header = binary.LittleEndian.AppendUint32(header, uint32(dataLength/(2*bytesPerSample)))
+	}
+	header = append(header, "data"...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(dataLength))
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(header)-8+dataLength))
+	return header
+}